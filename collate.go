@@ -0,0 +1,140 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// name of the sqlite driver openDatabase uses, its connections know every registered collation
+const driverName = "sqlite3_mapreduce"
+
+// collations are the orderings queries can use on top of sqlite's own, by name
+var collations = struct {
+	sync.Mutex
+	byName map[string]func(a, b string) int
+	next   int
+}{byName: make(map[string]func(a, b string) int)}
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			collations.Lock()
+			defer collations.Unlock()
+			for name, cmp := range collations.byName {
+				if err := conn.RegisterCollation(name, cmp); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// registerCollation makes less usable in queries, as "collate <name>", on databases opened from now on
+// until release is called
+func registerCollation(less func(a, b string) bool) (name string, release func()) {
+	collations.Lock()
+	defer collations.Unlock()
+	collations.next++
+	name = fmt.Sprintf("mapreduce_%d", collations.next)
+	collations.byName[name] = func(a, b string) int {
+		if less(a, b) {
+			return -1
+		}
+		if less(b, a) {
+			return 1
+		}
+		return 0
+	}
+	return name, func() {
+		collations.Lock()
+		defer collations.Unlock()
+		delete(collations.byName, name)
+	}
+}
+
+// keyOrders are the orderings of keys a job can ask for by name, instead of sqlite's text order
+var keyOrders = map[string]func(a, b string) bool{
+	"numeric": lessNumeric,
+	"nocase":  lessNoCase,
+	"unicode": lessUnicode,
+}
+
+// checkKeyOrder makes sure order names one of keyOrders, or is empty for sqlite's text order
+func checkKeyOrder(order string) error {
+	if _, ok := keyOrders[order]; order != "" && !ok {
+		return fmt.Errorf("unknown key order '%s', expected numeric, nocase or unicode", order)
+	}
+	return nil
+}
+
+// keyLess returns how a job orders its keys: by the client's LessKey if it is a KeySorter,
+// otherwise by the named order. It returns nil for sqlite's text order.
+func keyLess(client Interface, order string) func(a, b string) bool {
+	if k, ok := client.(KeySorter); ok {
+		return k.LessKey
+	}
+	return keyOrders[order]
+}
+
+// sortKeys sorts keys by less, or in text order if less is nil
+func sortKeys(keys []string, less func(a, b string) bool) {
+	if less == nil {
+		sort.Strings(keys)
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+}
+
+// lessNumeric orders keys that are numbers by their value, before any keys that are not, which are in text order
+func lessNumeric(a, b string) bool {
+	x, aNumber := number(a)
+	y, bNumber := number(b)
+	switch {
+	case aNumber && bNumber:
+		return x < y
+	case aNumber != bNumber:
+		return aNumber
+	}
+	return a < b
+}
+
+// number parses s as a number, ok is false if it is not one
+func number(s string) (f float64, ok bool) {
+	s = strings.TrimSpace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if math.IsInf(f, 0) {
+		// "inf" and "infinity" are words, but a number too large for a float64 goes after the others
+		return f, !strings.ContainsAny(s, "iI")
+	}
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// lessNoCase orders keys in text order, ignoring case
+func lessNoCase(a, b string) bool {
+	return strings.ToLower(a) < strings.ToLower(b)
+}
+
+// unicodeCollator holds the Unicode Collation Algorithm's language independent order, a collator
+// keeps buffers between comparisons so it is used by one comparison at a time
+var unicodeCollator = struct {
+	sync.Mutex
+	*collate.Collator
+}{Collator: collate.New(language.Und)}
+
+// lessUnicode orders keys the way a reader would rather than by their bytes, by the Unicode Collation Algorithm:
+// accents and case only tell apart keys that are otherwise equal, so "Émile" goes between "emil" and "emily"
+func lessUnicode(a, b string) bool {
+	unicodeCollator.Lock()
+	defer unicodeCollator.Unlock()
+	return unicodeCollator.CompareString(a, b) < 0
+}
@@ -0,0 +1,39 @@
+package mapreduce
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLessNumeric(t *testing.T) {
+	keys := []string{"10", "b", "-3", "2.5", "a", " 7", "1e2", "NaN", "2", "infinity", "Inf", "-1e999"}
+	sortKeys(keys, lessNumeric)
+	want := []string{"-1e999", "-3", "2", "2.5", " 7", "10", "1e2", "Inf", "NaN", "a", "b", "infinity"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %q, want %q", keys, want)
+	}
+	if lessNumeric("1", "1.0") || lessNumeric("1.0", "1") {
+		t.Errorf("1 and 1.0 should be tied")
+	}
+}
+
+func TestLessNoCase(t *testing.T) {
+	keys := []string{"banana", "Apple", "cherry", "apricot", "Date"}
+	sortKeys(keys, lessNoCase)
+	want := []string{"Apple", "apricot", "banana", "cherry", "Date"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %q, want %q", keys, want)
+	}
+	if lessNoCase("banana", "Banana") || lessNoCase("Banana", "banana") {
+		t.Errorf("banana and Banana should be tied")
+	}
+}
+
+func TestLessUnicode(t *testing.T) {
+	keys := []string{"emily", "Zoë", "Émile", "zebra", "emil", "Ångström", "apple"}
+	sortKeys(keys, lessUnicode)
+	want := []string{"Ångström", "apple", "emil", "Émile", "emily", "zebra", "Zoë"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %q, want %q", keys, want)
+	}
+}
@@ -2,4 +2,7 @@ module mapreduce
 
 go 1.15
 
-require github.com/mattn/go-sqlite3 v1.14.6
+require (
+	github.com/mattn/go-sqlite3 v1.14.6
+	golang.org/x/text v0.3.8
+)
@@ -0,0 +1,357 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// JobSpec (Name, Source, Output, M, R, SkipBadRecords, TotalOrder, KeyOrder)
+type JobSpec struct {
+	Name           string // unique name, also the job's directory on the master and workers
+	Source         string // input database, as seen by the master
+	Output         string // output database, ResultsOf-<source> next to the source if empty
+	M, R           int    // number of map and reduce tasks
+	SkipBadRecords int    // if above 0, an input record that makes Map fail this many times is skipped
+	TotalOrder     bool   // partition keys by range, on a sample of the input's keys, so the output is sorted by key
+	KeyOrder       string // "numeric", "nocase" or "unicode" to order keys that way, empty for sqlite's text order
+}
+
+// Lease (Worker, Started, Deadline)
+type Lease struct {
+	Worker   string    // address of the worker running the attempt
+	Started  time.Time // when the attempt was handed out
+	Deadline time.Time // lease expiry, the attempt is abandoned after this unless the worker's heartbeats renew it
+}
+
+// TaskStatus (State, Worker, Attempts, Running, Failures, LastError)
+type TaskStatus struct {
+	State     int                  // 0 for idle, 1 for in progress, 2 for completed
+	Worker    string               // address of the worker that completed the task
+	Attempts  int                  // number of attempts handed out so far
+	Running   map[int]Lease        // attempts still in progress, by attempt number
+	Failures  int                  // number of attempts that returned an error
+	LastError string               // error of the most recent failed attempt
+	FailedOn  []string             // workers an attempt failed on, retries go elsewhere when possible
+	Records   map[string]int       // failed attempts per input record, in skip mode
+	Tried     []string             // workers an attempt was started on, they may still hold a map task's input
+	Replicas  []string             // other workers holding a copy of a reduce task's output
+	Copying   map[string]time.Time // workers copying a reduce task's output, with the time they have to finish
+}
+
+// Event (Kind, WorkType, Task, Attempt, Worker, Error, Record)
+// Every change to a task's state is an event, written to the journal before it is applied
+type Event struct {
+	Kind     string // "start", "complete", "abandon", "fail", "reset", "replica" or "lost"
+	WorkType int    // 1 for mapping, 2 for reducing
+	Task     int
+	Attempt  int
+	Worker   string
+	Error    string // why the attempt failed, for "fail" events
+	Record   string // key of the input record the attempt failed on, for "fail" events in skip mode
+}
+
+// Job (JobSpec, task tables)
+type Job struct {
+	JobSpec
+	MapTasks     []MapTask
+	ReduceTasks  []ReduceTask
+	MapStatus    []TaskStatus
+	ReduceStatus []TaskStatus
+	ReducePhase  bool      // set once the job's driver starts the reduce phase
+	Aborted      bool      // set by CancelJob, or when the job fails, no more tasks are handed out
+	Failed       string    // why the job failed, set once a task has failed maxTaskFailures times
+	Journal      *journal  // durable log of every task event, nil while replaying
+	Progressed   time.Time // when a task of the job first completed since the master started, zero until then
+}
+
+// checkJobName makes sure a job name is usable as a directory name
+func checkJobName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid job name '%s'", name)
+	}
+	return nil
+}
+
+// newJob builds the task tables for a job, its map tasks read their input from the master at address.
+// In total order mode splitPoints are the keys the map tasks partition their output at.
+func newJob(spec JobSpec, address string, splitPoints []string) *Job {
+	job := &Job{JobSpec: spec}
+	for i := 0; i < spec.M; i++ {
+		job.MapTasks = append(job.MapTasks, MapTask{Job: spec.Name, M: spec.M, R: spec.R, N: i, SourceHost: address, SkipMode: spec.SkipBadRecords > 0, SplitPoints: splitPoints, KeyOrder: spec.KeyOrder})
+		job.MapStatus = append(job.MapStatus, TaskStatus{})
+	}
+	for i := 0; i < spec.R; i++ {
+		hosts := make([]string, spec.M)
+		job.ReduceTasks = append(job.ReduceTasks, ReduceTask{Job: spec.Name, M: spec.M, R: spec.R, N: i, SourceHosts: hosts, KeyOrder: spec.KeyOrder})
+		job.ReduceStatus = append(job.ReduceStatus, TaskStatus{})
+	}
+	return job
+}
+
+// status returns the task table for workType
+func (j *Job) status(workType int) []TaskStatus {
+	if workType == 2 {
+		return j.ReduceStatus
+	}
+	return j.MapStatus
+}
+
+// pickTask returns the index of an idle task, or -1 if there is none.
+// With backup set it instead returns the slowest task with a single attempt running on
+// a worker other than ip, once the fraction after of the phase is completed. Whichever attempt finishes first wins.
+// Tasks for which avoid returns true are skipped.
+func pickTask(status []TaskStatus, ip string, backup bool, after float64, avoid func(int) bool) int {
+	completed := 0
+	for i := range status {
+		if status[i].State == 0 && !backup && !avoid(i) {
+			return i
+		}
+		if status[i].State == 2 {
+			completed++
+		}
+	}
+	if !backup || len(status) == 0 || float64(completed) < after*float64(len(status)) {
+		return -1
+	}
+	slowest := -1
+	var started time.Time
+	for i := range status {
+		if status[i].State != 1 || len(status[i].Running) != 1 || avoid(i) {
+			continue
+		}
+		for _, lease := range status[i].Running {
+			if lease.Worker != ip && (slowest < 0 || lease.Started.Before(started)) {
+				slowest = i
+				started = lease.Started
+			}
+		}
+	}
+	return slowest
+}
+
+// transition records e in the journal and applies it to the task tables,
+// giving up on the job once a task has failed maxTaskFailures times
+func (j *Job) transition(e Event) {
+	if j.Journal != nil {
+		if err := j.Journal.append(e); err != nil {
+			log.Fatalf("Error writing journal: %v\n", err)
+		}
+	}
+	j.apply(e)
+	if e.Kind == "complete" && j.Progressed.IsZero() {
+		j.Progressed = time.Now()
+	}
+	// the job is only given up on for failures seen live, a resumed job gets a fresh set of attempts
+	if e.Kind != "fail" || j.Failed != "" || e.Task < 0 || e.Task >= len(j.status(e.WorkType)) {
+		return
+	}
+	if task := &j.status(e.WorkType)[e.Task]; task.Failures >= maxTaskFailures {
+		kind := "map"
+		if e.WorkType == 2 {
+			kind = "reduce"
+		}
+		j.Failed = fmt.Sprintf("%s task #%v failed %v times, last on worker '%s': %s", kind, e.Task, task.Failures, e.Worker, e.Error)
+		j.Aborted = true
+	}
+}
+
+// apply changes the state of a task according to e, both for live events and journal replay
+func (j *Job) apply(e Event) {
+	status := j.status(e.WorkType)
+	if e.Task < 0 || e.Task >= len(status) {
+		return
+	}
+	task := &status[e.Task]
+	switch e.Kind {
+	case "start":
+		// a replayed attempt gets a fresh lease, its worker may still report in
+		if task.Running == nil {
+			task.Running = make(map[int]Lease)
+		}
+		if e.Attempt > task.Attempts {
+			task.Attempts = e.Attempt
+		}
+		now := time.Now()
+		task.Running[e.Attempt] = Lease{Worker: e.Worker, Started: now, Deadline: now.Add(taskLease)}
+		task.State = 1
+		if !task.triedOn(e.Worker) {
+			task.Tried = append(task.Tried, e.Worker)
+		}
+	case "complete":
+		// the first attempt to finish wins, any backups still running become stale
+		task.State = 2
+		task.Worker = e.Worker
+		task.Running = nil
+		if e.WorkType == 1 {
+			for r := range j.ReduceTasks {
+				j.ReduceTasks[r].SourceHosts[e.Task] = makeURL(e.Worker, jobFile(j.Name, mapOutputFile(e.Task, r)))
+			}
+		}
+	case "abandon":
+		task.abandon(e.Attempt)
+	case "fail":
+		// like abandon, but the error is kept so the master can show why the task is being retried
+		task.abandon(e.Attempt)
+		task.LastError = e.Error
+		if e.WorkType == 1 && e.Record != "" && j.SkipBadRecords > 0 {
+			// a bad record does not count against the task, it is skipped once it has failed SkipBadRecords times
+			if task.Records == nil {
+				task.Records = make(map[string]int)
+			}
+			task.Records[e.Record]++
+			if task.Records[e.Record] == j.SkipBadRecords {
+				j.MapTasks[e.Task].Skip = append(j.MapTasks[e.Task].Skip, e.Record)
+			}
+			break
+		}
+		task.Failures++
+		if !task.failedOn(e.Worker) {
+			task.FailedOn = append(task.FailedOn, e.Worker)
+		}
+	case "reset":
+		// a completed task goes back to idle, for map tasks this forgets where the output was
+		task.State = 0
+		task.Running = nil
+		task.Replicas = nil
+		if e.WorkType == 1 {
+			for r := range j.ReduceTasks {
+				j.ReduceTasks[r].SourceHosts[e.Task] = ""
+			}
+		}
+	case "replica":
+		// another worker holds a copy of the reduce output
+		task.Replicas = append(task.Replicas, e.Worker)
+	case "lost":
+		// a worker holding a copy of the reduce output is gone, a replica takes its place,
+		// and once no copy is left the task runs again
+		for i, w := range task.Replicas {
+			if w == e.Worker {
+				task.Replicas = append(task.Replicas[:i:i], task.Replicas[i+1:]...)
+				break
+			}
+		}
+		if task.State == 2 && task.Worker == e.Worker {
+			if len(task.Replicas) > 0 {
+				task.Worker, task.Replicas = task.Replicas[0], task.Replicas[1:]
+			} else {
+				task.State = 0
+				task.Running = nil
+			}
+		}
+	}
+}
+
+// abandon drops an attempt of the task, the task returns to idle once no attempts are left
+func (t *TaskStatus) abandon(attempt int) {
+	delete(t.Running, attempt)
+	if t.State == 1 && len(t.Running) == 0 {
+		t.State = 0
+	}
+}
+
+// failedOn reports whether an attempt of the task has failed on the worker at ip
+func (t *TaskStatus) failedOn(ip string) bool {
+	for _, w := range t.FailedOn {
+		if w == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// triedOn reports whether an attempt of the task was started on the worker at ip
+func (t *TaskStatus) triedOn(ip string) bool {
+	for _, w := range t.Tried {
+		if w == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether the worker at ip holds the task's output, or a copy of it
+func (t *TaskStatus) holds(ip string) bool {
+	if t.Worker == ip {
+		return true
+	}
+	for _, w := range t.Replicas {
+		if w == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// release abandons every attempt running on the worker at ip
+func (j *Job) release(ip string) {
+	for _, workType := range []int{1, 2} {
+		status := j.status(workType)
+		for i := range status {
+			for attempt, lease := range status[i].Running {
+				if lease.Worker == ip {
+					j.transition(Event{Kind: "abandon", WorkType: workType, Task: i, Attempt: attempt})
+				}
+			}
+		}
+	}
+}
+
+// expireLeases abandons attempts whose lease has run out, so that a worker
+// that died mid-task does not stall the job. It reports whether any lease expired.
+func (j *Job) expireLeases() bool {
+	expired := false
+	now := time.Now()
+	for i := range j.MapStatus {
+		for attempt, lease := range j.MapStatus[i].Running {
+			if now.After(lease.Deadline) {
+				fmt.Printf("Worker '%s' lease on map job #%v of '%s' expired, returning it to the pool\n", lease.Worker, i, j.Name)
+				j.transition(Event{Kind: "abandon", WorkType: 1, Task: i, Attempt: attempt})
+				expired = true
+			}
+		}
+	}
+	for i := range j.ReduceStatus {
+		for attempt, lease := range j.ReduceStatus[i].Running {
+			if now.After(lease.Deadline) {
+				fmt.Printf("Worker '%s' lease on reduce job #%v of '%s' expired, returning it to the pool\n", lease.Worker, i, j.Name)
+				j.transition(Event{Kind: "abandon", WorkType: 2, Task: i, Attempt: attempt})
+				expired = true
+			}
+		}
+	}
+	return expired
+}
+
+// mapsDone reports whether every map task has completed
+func (j *Job) mapsDone() bool {
+	for i := range j.MapStatus {
+		if j.MapStatus[i].State != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// reducesDone reports whether the reduce phase has started and every reduce task has completed
+func (j *Job) reducesDone() bool {
+	if !j.ReducePhase {
+		return false
+	}
+	for i := range j.ReduceStatus {
+		if j.ReduceStatus[i].State != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// workerList returns the address of the worker that completed each task
+func workerList(status []TaskStatus) []string {
+	var list []string
+	for _, v := range status {
+		list = append(list, v.Worker)
+	}
+	return list
+}
@@ -0,0 +1,194 @@
+package mapreduce
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, journalFile)
+	spec := JobSpec{Name: "job", Source: "input.db", M: 3, R: 2, TotalOrder: true, KeyOrder: "numeric"}
+	points := []string{"10"}
+
+	// run part of a job, as a master would before crashing
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.setJob(spec, points); err != nil {
+		t.Fatal(err)
+	}
+	live := newJob(spec, "master:1", points)
+	live.Journal = j
+	live.transition(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	live.transition(Event{Kind: "complete", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	live.transition(Event{Kind: "start", WorkType: 1, Task: 1, Attempt: 1, Worker: "a"})
+	live.transition(Event{Kind: "fail", WorkType: 1, Task: 1, Attempt: 1, Worker: "a", Error: "boom"})
+	live.transition(Event{Kind: "start", WorkType: 1, Task: 1, Attempt: 2, Worker: "b"})
+	live.transition(Event{Kind: "start", WorkType: 1, Task: 2, Attempt: 1, Worker: "b"})
+	live.transition(Event{Kind: "abandon", WorkType: 1, Task: 2, Attempt: 1})
+	j.Close()
+
+	// a restarted master replays the journal into a fresh job
+	j, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	recorded, splitPoints, ok, err := j.job()
+	if err != nil || !ok || recorded != (JobSpec{Source: spec.Source, M: spec.M, R: spec.R, TotalOrder: true, KeyOrder: "numeric"}) || !reflect.DeepEqual(splitPoints, points) {
+		t.Fatalf("job() = %+v, %q, %v, %v", recorded, splitPoints, ok, err)
+	}
+	events, err := j.events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 7 {
+		t.Fatalf("replayed %v events, want 7", len(events))
+	}
+	job := newJob(spec, "master:1", splitPoints)
+	for _, e := range events {
+		job.apply(e)
+	}
+
+	if s := job.MapStatus[0]; s.State != 2 || s.Worker != "a" || len(s.Running) != 0 {
+		t.Errorf("map task #0 = %+v, want completed on a", s)
+	}
+	for i := range job.ReduceTasks {
+		if want := makeURL("a", jobFile("job", mapOutputFile(0, i))); job.ReduceTasks[i].SourceHosts[0] != want {
+			t.Errorf("reduce task #%v fetches map output #0 from %q, want %q", i, job.ReduceTasks[i].SourceHosts[0], want)
+		}
+	}
+	s := job.MapStatus[1]
+	if s.State != 1 || s.Attempts != 2 || s.Failures != 1 || s.LastError != "boom" || !s.failedOn("a") {
+		t.Errorf("map task #1 = %+v, want running its second attempt after one failure on a", s)
+	}
+	if lease, ok := s.Running[2]; !ok || lease.Worker != "b" || !lease.Deadline.After(time.Now()) {
+		t.Errorf("map task #1 runs %+v, want a fresh lease for attempt 2 on b", s.Running)
+	}
+	if s := job.MapStatus[2]; s.State != 0 || len(s.Running) != 0 || !s.triedOn("b") {
+		t.Errorf("map task #2 = %+v, want idle after its attempt on b was abandoned", s)
+	}
+	if job.mapsDone() {
+		t.Errorf("mapsDone() = true with two map tasks left")
+	}
+}
+
+func TestPickTaskSpeculation(t *testing.T) {
+	none := func(int) bool { return false }
+	now := time.Now()
+	running := func(worker string, started time.Time) TaskStatus {
+		return TaskStatus{State: 1, Attempts: 1, Running: map[int]Lease{1: {Worker: worker, Started: started}}}
+	}
+	done := TaskStatus{State: 2, Worker: "a"}
+
+	status := []TaskStatus{done, done, running("a", now.Add(-time.Minute)), running("b", now.Add(-time.Hour))}
+	if i := pickTask(status, "c", false, speculateAfter, none); i != -1 {
+		t.Errorf("pickTask without backup = %v, want -1 with no idle task", i)
+	}
+	if i := pickTask(status, "c", true, 0.75, none); i != -1 {
+		t.Errorf("pickTask with half the phase done = %v, want -1 before 75%%", i)
+	}
+	if i := pickTask(status, "c", true, 0.5, none); i != 3 {
+		t.Errorf("pickTask = %v, want the slowest task 3", i)
+	}
+	if i := pickTask(status, "b", true, 0.5, none); i != 2 {
+		t.Errorf("pickTask for b = %v, want 2 as b already runs task 3", i)
+	}
+	if i := pickTask(status, "c", true, 0.5, func(i int) bool { return i == 3 }); i != 2 {
+		t.Errorf("pickTask avoiding 3 = %v, want 2", i)
+	}
+
+	// a task with a backup running is not backed up again
+	status[3].Running[2] = Lease{Worker: "c", Started: now}
+	if i := pickTask(status, "d", true, 0.5, none); i != 2 {
+		t.Errorf("pickTask with task 3 backed up = %v, want 2", i)
+	}
+
+	// idle tasks come first
+	status = append(status, TaskStatus{})
+	if i := pickTask(status, "c", false, 0.5, none); i != 4 {
+		t.Errorf("pickTask = %v, want the idle task 4", i)
+	}
+}
+
+func TestResumedJobIsNotGivenUpOn(t *testing.T) {
+	spec := JobSpec{Name: "job", M: 1, R: 1}
+	live := newJob(spec, "master:1", nil)
+	var events []Event
+	for attempt := 1; attempt <= maxTaskFailures; attempt++ {
+		for _, e := range []Event{
+			{Kind: "start", WorkType: 1, Task: 0, Attempt: attempt, Worker: "a"},
+			{Kind: "fail", WorkType: 1, Task: 0, Attempt: attempt, Worker: "a", Error: "boom"},
+		} {
+			live.transition(e)
+			events = append(events, e)
+		}
+	}
+	if !live.Aborted || live.Failed == "" {
+		t.Fatalf("job was not given up on after %v failures", maxTaskFailures)
+	}
+
+	actor, stop := startMActor()
+	defer stop()
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	j, err := openJournal(filepath.Join(tempdir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for _, e := range events {
+		if err := j.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := newJob(spec, "master:1", nil)
+	if _, err := actor.startJob(job, j); err != nil {
+		t.Fatal(err)
+	}
+	var aborted bool
+	var task TaskStatus
+	finished := make(chan struct{})
+	actor <- func(f *Master) {
+		aborted, task = job.Aborted, job.MapStatus[0]
+		finished <- struct{}{}
+	}
+	<-finished
+	if aborted {
+		t.Fatalf("resumed job was given up on: %q", job.Failed)
+	}
+	if task.State != 0 || task.Failures != 0 || !task.failedOn("a") || task.LastError != "boom" {
+		t.Errorf("map task #0 = %+v, want idle with fresh attempts, remembering it failed on a", task)
+	}
+}
+
+func TestSkipModeSkipsARecordOnceItFailedOften(t *testing.T) {
+	job := newJob(JobSpec{Name: "job", M: 1, R: 1, SkipBadRecords: 2}, "master:1", nil)
+	for attempt := 1; attempt <= 2; attempt++ {
+		job.transition(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: attempt, Worker: "a"})
+		job.transition(Event{Kind: "fail", WorkType: 1, Task: 0, Attempt: attempt, Worker: "a", Error: "bad", Record: "17"})
+	}
+	task := job.MapStatus[0]
+	if task.Records["17"] != 2 || task.Failures != 0 || task.State != 0 {
+		t.Errorf("map task #0 = %+v, want two failures of record 17 that do not count against the task", task)
+	}
+	if skip := job.MapTasks[0].Skip; len(skip) != 1 || skip[0] != "17" {
+		t.Errorf("map task #0 skips %q, want record 17", skip)
+	}
+	if job.Aborted {
+		t.Errorf("job was given up on for a bad record")
+	}
+}
@@ -0,0 +1,125 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// name of the journal inside the job directory
+const journalFile = "journal.db"
+
+// journal is an append only log of the master's task events, stored as a sqlite file in the job directory.
+// A master restarted with the same job directory replays it and carries on from where it left off.
+type journal struct {
+	db *sql.DB
+}
+
+// openJournal opens the journal at path, creating it if it does not exist yet
+func openJournal(path string) (*journal, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	}
+	// unlike the task databases the journal has to survive a crash of the master, so
+	// every event is written ahead and synced before the master acts on it
+	options :=
+		"?" + "_busy_timeout=10000" +
+			"&" + "_journal_mode=WAL" +
+			"&" + "_locking_mode=NORMAL" +
+			"&" + "mode=rw" +
+			"&" + "_synchronous=FULL"
+	db, err := sql.Open("sqlite3", path+options)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("create table if not exists job (m integer, r integer, source text, skip integer, totalorder integer, keyorder text);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("create table if not exists splitpoints (key text);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("create table if not exists events (kind text, worktype integer, task integer, attempt integer, worker text, error text, record text);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &journal{db: db}, nil
+}
+
+// job returns the settings of the job recorded in the journal, and its split points in total order mode.
+// ok is false if the input has not been split yet
+func (j *journal) job() (spec JobSpec, splitPoints []string, ok bool, err error) {
+	err = j.db.QueryRow("select m, r, source, skip, totalorder, keyorder from job").Scan(&spec.M, &spec.R, &spec.Source, &spec.SkipBadRecords, &spec.TotalOrder, &spec.KeyOrder)
+	if err == sql.ErrNoRows {
+		return JobSpec{}, nil, false, nil
+	}
+	if err != nil {
+		return JobSpec{}, nil, false, err
+	}
+	rows, err := j.db.Query("select key from splitpoints order by rowid")
+	if err != nil {
+		return JobSpec{}, nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return JobSpec{}, nil, false, err
+		}
+		splitPoints = append(splitPoints, key)
+	}
+	return spec, splitPoints, true, rows.Err()
+}
+
+// setJob records that spec.Source has been split into spec.M map tasks feeding spec.R reduce tasks,
+// along with the settings that decide how map outputs are partitioned, and the split points in total order mode
+func (j *journal) setJob(spec JobSpec, splitPoints []string) error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("insert into job (m, r, source, skip, totalorder, keyorder) values (?,?,?,?,?,?)", spec.M, spec.R, spec.Source, spec.SkipBadRecords, spec.TotalOrder, spec.KeyOrder); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, key := range splitPoints {
+		if _, err := tx.Exec("insert into splitpoints (key) values (?)", key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (j *journal) append(e Event) error {
+	_, err := j.db.Exec("insert into events (kind, worktype, task, attempt, worker, error, record) values (?,?,?,?,?,?,?)", e.Kind, e.WorkType, e.Task, e.Attempt, e.Worker, e.Error, e.Record)
+	return err
+}
+
+// events returns every event in the journal, oldest first
+func (j *journal) events() ([]Event, error) {
+	rows, err := j.db.Query("select kind, worktype, task, attempt, worker, error, record from events order by rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Kind, &e.WorkType, &e.Task, &e.Attempt, &e.Worker, &e.Error, &e.Record); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (j *journal) Close() error {
+	return j.db.Close()
+}
@@ -2,16 +2,24 @@ package mapreduce
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -19,22 +27,141 @@ import (
 
 func Start(client Interface, INPUT_FILE_NAME string) error {
 	log.SetFlags(log.Ltime | log.Lshortfile)
-	runtime.GOMAXPROCS(1)
 
 	// get argument data from command line
 	args := os.Args[1:]
 
-	if len(args) == 2 { //worker
-		return worker(client, args[0], args[1])
+	if len(args) == 2 && args[0] == "serve" { //long-lived master running submitted jobs
+		return serve(client, args[1], "1")
+	} else if len(args) == 3 && args[0] == "serve" {
+		return serve(client, args[1], args[2])
+	} else if len(args) == 6 && args[0] == "submit" { //submit a job to a long-lived master
+		return submit(args[1], args[2], args[3], args[4], args[5], "0", "", "false")
+	} else if len(args) == 7 && args[0] == "submit" { //submit a job that skips records Map keeps failing on
+		return submit(args[1], args[2], args[3], args[4], args[5], args[6], "", "false")
+	} else if len(args) == 8 && args[0] == "submit" { //submit a job with an order of keys
+		return submit(args[1], args[2], args[3], args[4], args[5], args[6], args[7], "false")
+	} else if len(args) == 9 && args[0] == "submit" { //submit a job whose output is sorted across reduce tasks
+		return submit(args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8])
+	} else if len(args) == 3 && args[0] == "cancel" { //cancel a queued or running job
+		return cancel(args[1], args[2])
+	} else if len(args) == 2 && args[0] == "status" { //list the workers known to a master
+		return status(args[1])
+	} else if len(args) == 3 && args[0] == "drain" { //take a worker out of service
+		return drain(args[1], args[2])
+	} else if len(args) == 4 && args[0] == "worker" { //worker with a number of task slots
+		return worker(client, args[1], args[2], args[3])
+	} else if len(args) == 2 { //worker, one slot per cpu
+		return worker(client, args[0], args[1], strconv.Itoa(runtime.NumCPU()))
 	} else if len(args) == 3 { //master
-		return master(client, args[0], args[1], args[2], INPUT_FILE_NAME)
+		return master(client, args[0], args[1], args[2], INPUT_FILE_NAME, "", "false")
+	} else if len(args) == 4 { //master with a job directory that survives restarts
+		return master(client, args[0], args[1], args[2], INPUT_FILE_NAME, args[3], "false")
+	} else if len(args) == 5 { //master with a job directory, in total order mode
+		return master(client, args[0], args[1], args[2], INPUT_FILE_NAME, args[3], args[4])
 	} else { // throw error
-		log.Fatalf("\nPlease supply arguments for one of the following:\nMaster Node: [PortNumber, NumberOfMapTasks, NumberOfReduceTasks]\nWorker Node: [PortNumber, MasterPortNumber]\n")
+		log.Fatalf("\nPlease supply arguments for one of the following:\nMaster Node: [PortNumber, NumberOfMapTasks, NumberOfReduceTasks, (JobDirectory), (TotalOrder)]\nJob Server: [serve, PortNumber, (MaxConcurrentJobs)]\nSubmit Job: [submit, MasterPortNumber, InputFile, NumberOfMapTasks, NumberOfReduceTasks, JobName, (SkipBadRecordsAfter), (KeyOrder), (TotalOrder)]\nCancel Job: [cancel, MasterPortNumber, JobName]\nWorker Status: [status, MasterPortNumber]\nDrain Worker: [drain, MasterPortNumber, WorkerAddress]\nWorker Node: [PortNumber, MasterPortNumber] or [worker, PortNumber, MasterPortNumber, TaskSlots]\n")
 	}
 	return nil
 }
 
-func master(client Interface, portNumber string, map_tasks string, reduce_tasks string, source_filename string) error {
+// MasterConfig (Client, Port, Address, Input, Output, M, R, Name, TempDir, SkipBadRecords, TotalOrder, KeyOrder)
+type MasterConfig struct {
+	Client         Interface // optional, used to sample the keys Map outputs in total order mode, and for a KeySorter's order
+	Port           int       // port the master serves its rpc and files on
+	Address        string    // address workers reach the master at, this host's address on Port if empty
+	Input          string    // input database
+	Output         string    // output database, ResultsOf-<input> next to the input if empty
+	M, R           int       // number of map and reduce tasks
+	Name           string    // job name, named after the input if empty
+	TempDir        string    // directory holding the job's directory, a new one that is deleted on return if empty
+	SkipBadRecords int       // if above 0, an input record that makes Map fail this many times is skipped
+	TotalOrder     bool      // partition keys by range so the output is sorted by key, without a Client the input's keys are sampled
+	KeyOrder       string    // "numeric", "nocase" or "unicode" to order keys that way, the output is then sorted by key
+}
+
+// RunMaster runs one job as set out by config: it splits the input, waits for workers to map and
+// reduce it, and merges their outputs into config.Output. Workers are told to shut down before it returns.
+// The job's journal is kept in config.TempDir, so a master restarted with the same TempDir resumes the job.
+// Only the job's own directory in TempDir is deleted, once the job has succeeded or was cancelled. Cancelling ctx cancels the job.
+func RunMaster(ctx context.Context, config MasterConfig) (err error) {
+	if config.Name == "" {
+		config.Name = defaultJobName(config.Input)
+	}
+	if err := checkJobName(config.Name); err != nil {
+		return err
+	}
+	if config.M < 1 || config.R < 1 {
+		return fmt.Errorf("job '%s' needs at least one map and one reduce task", config.Name)
+	}
+	if err := checkKeyOrder(config.KeyOrder); err != nil {
+		return err
+	}
+	if config.Address == "" {
+		if config.Address, err = getLocalAddress(config.Port); err != nil {
+			return err
+		}
+	}
+	tempdir := config.TempDir
+	if tempdir == "" {
+		tempdir, err = ioutil.TempDir("", "mapreduce.")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if keptJournal(err, filepath.Join(tempdir, config.Name)) {
+				fmt.Printf("Keeping the journal of '%s' in %s, pass it as TempDir to resume the job\n", config.Name, tempdir)
+			} else {
+				os.RemoveAll(tempdir)
+			}
+		}()
+	} else if err := os.MkdirAll(tempdir, 0775); err != nil {
+		return err
+	}
+
+	actor, stop, err := masterServer(config.Address, config.Port, tempdir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	fmt.Printf("TEMP DIR: %s\n", tempdir)
+
+	spec := JobSpec{Name: config.Name, Source: config.Input, Output: config.Output, M: config.M, R: config.R, SkipBadRecords: config.SkipBadRecords, TotalOrder: config.TotalOrder, KeyOrder: config.KeyOrder}
+	_, err = runJob(ctx, actor, config.Client, tempdir, config.Address, spec)
+
+	// shutdown any workers and wait a moment to ensure they hear about it
+	var junk Nothing
+	actor.Shutdown(junk, &junk)
+	time.Sleep(1 * time.Second)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	// the journal is no use once the output is merged
+	os.RemoveAll(filepath.Join(tempdir, config.Name))
+	return nil
+}
+
+// WorkerConfig (Client, Port, Address, Master, Slots, TempDir)
+type WorkerConfig struct {
+	Client  Interface // the Map and Reduce functions
+	Port    int       // port the worker serves its files on
+	Address string    // address the master and other workers reach this worker at, this host's address on Port if empty
+	Master  string    // address of the master, required
+	Slots   int       // number of tasks run at a time, one per cpu if 0
+	TempDir string    // directory for task files, a new one that is deleted on return if empty
+}
+
+// RunWorker joins the master at config.Master and runs the tasks it hands out,
+// until the master shuts down, the worker is drained, or ctx is cancelled.
+func RunWorker(ctx context.Context, config WorkerConfig) error {
+	_, err := runWorker(ctx, config)
+	return err
+}
+
+func master(client Interface, portNumber string, map_tasks string, reduce_tasks string, source_filename string, jobdir string, total_order string) error {
 	// collect arguments into int values
 	MAP_TASKS, err := strconv.Atoi(map_tasks)
 	if err != nil {
@@ -48,136 +175,856 @@ func master(client Interface, portNumber string, map_tasks string, reduce_tasks
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
+	TOTAL_ORDER, err := strconv.ParseBool(total_order)
+	if err != nil {
+		log.Fatalf("invalid total order '%s', expected true or false\n", total_order)
+	}
+
+	//setup tempdir
+	// a job directory is kept between runs so a crashed master can resume from its journal,
+	// it belongs to the user so only the job's own files in it are deleted
+	tempdir := filepath.Join(os.TempDir(), fmt.Sprintf("mapreduce.%d", os.Getpid()))
+	if jobdir != "" {
+		tempdir, err = filepath.Abs(jobdir)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	} else {
+		os.RemoveAll(tempdir)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+
+	config := MasterConfig{Client: client, Port: PORT, Input: source_filename, M: MAP_TASKS, R: REDUCE_TASKS, TempDir: tempdir, TotalOrder: TOTAL_ORDER}
+	if err := RunMaster(context.Background(), config); err != nil {
+		if jobdir == "" {
+			if keptJournal(err, filepath.Join(tempdir, defaultJobName(source_filename))) {
+				fmt.Printf("Keeping the journal in %s, pass it as the JobDirectory to resume the job\n", tempdir)
+			} else {
+				os.RemoveAll(tempdir)
+			}
+		}
+		return err
+	}
+	if jobdir == "" {
+		defer os.RemoveAll(tempdir)
+	}
+
+	// Stall for user input before quitting and deleting temp files
+	if jobdir != "" {
+		fmt.Printf("'%s' created. Press enter to quit", defaultOutput(source_filename))
+	} else {
+		fmt.Printf("'%s' created. Press enter to delete all temp data in: %s", defaultOutput(source_filename), tempdir)
+	}
+	scanner.Scan()
+
+	return nil
+}
+
+// serve runs a long-lived master, running jobs submitted over rpc against one pool of workers
+func serve(client Interface, portNumber string, max_jobs string) error {
+	PORT, err := strconv.Atoi(portNumber)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	MAX_JOBS, err := strconv.Atoi(max_jobs)
+	if err != nil || MAX_JOBS < 1 {
+		log.Fatalf("invalid number of concurrent jobs '%s'\n", max_jobs)
+	}
 
 	//setup tempdir and http server
 	tempdir := filepath.Join(os.TempDir(), fmt.Sprintf("mapreduce.%d", os.Getpid()))
 	os.RemoveAll(tempdir)
 	os.Mkdir(tempdir, 0775)
 	defer os.RemoveAll(tempdir)
-	address := getLocalAddress(PORT)
-	scanner := bufio.NewScanner(os.Stdin)
+	address, err := getLocalAddress(PORT)
+	if err != nil {
+		return err
+	}
 
-	actor := masterServer(address, PORT, tempdir)
+	actor, _, err := masterServer(address, PORT, tempdir)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("TEMP DIR: %s\n", tempdir)
-	fmt.Printf("Starting Mapreduce. Splitting %s into %v map tasks and %v reduce tasks\n", source_filename, MAP_TASKS, REDUCE_TASKS)
+	fmt.Printf("Waiting for jobs, running up to %v at a time\n", MAX_JOBS)
+
+	// each running job holds a slot until its output is merged
+	slots := make(chan struct{}, MAX_JOBS)
+	var junk Nothing
+	for {
+		slots <- struct{}{}
+		var spec JobSpec
+		actor.NextJob(junk, &spec)
+		if spec.Name == "" {
+			<-slots
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		go func(spec JobSpec) {
+			outputFileName, err := runJob(context.Background(), actor, client, tempdir, address, spec)
+			if err != nil {
+				fmt.Printf("Job '%s' failed: %v\n", spec.Name, err)
+			} else {
+				fmt.Printf("Job '%s' done, '%s' created\n", spec.Name, outputFileName)
+			}
+			<-slots
+		}(spec)
+	}
+}
+
+// submit queues a job on the long-lived master listening on masterPort.
+// With skip_after above 0, input records that make Map fail that many times are skipped.
+// key_order is empty, or numeric, nocase or unicode to order the job's keys that way.
+// With total_order true the keys are range partitioned, so the output is sorted across reduce tasks.
+func submit(masterPort string, source_filename string, map_tasks string, reduce_tasks string, name string, skip_after string, key_order string, total_order string) error {
+	masterPortNumber, err := strconv.Atoi(masterPort)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	MAP_TASKS, err := strconv.Atoi(map_tasks)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	REDUCE_TASKS, err := strconv.Atoi(reduce_tasks)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	SKIP_AFTER, err := strconv.Atoi(skip_after)
+	if err != nil || SKIP_AFTER < 0 {
+		log.Fatalf("invalid number of failures before skipping a record '%s'\n", skip_after)
+	}
+	TOTAL_ORDER, err := strconv.ParseBool(total_order)
+	if err != nil {
+		log.Fatalf("invalid total order '%s', expected true or false\n", total_order)
+	}
+	maddress, err := getLocalAddress(masterPortNumber)
+	if err != nil {
+		return err
+	}
+
+	// the master resolves the input's path in its own working directory
+	source, err := filepath.Abs(source_filename)
+	if err != nil {
+		return err
+	}
+	spec := JobSpec{Name: name, Source: source, M: MAP_TASKS, R: REDUCE_TASKS, SkipBadRecords: SKIP_AFTER, KeyOrder: key_order, TotalOrder: TOTAL_ORDER}
+	var junk Nothing
+	if err := callErr(maddress, "Server.Submit", &spec, &junk); err != nil {
+		return err
+	}
+	fmt.Printf("Job '%s' submitted to %s\n", name, maddress)
+	return nil
+}
 
-	// split INPUT_FILE_NAME into MAP_TASKS files
-	_, err = splitDatabase(source_filename, filepath.Join(tempdir), "map_%d_source.db", MAP_TASKS)
+// cancel asks the long-lived master listening on masterPort to cancel a job
+func cancel(masterPort string, name string) error {
+	masterPortNumber, err := strconv.Atoi(masterPort)
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
+	maddress, err := getLocalAddress(masterPortNumber)
+	if err != nil {
+		return err
+	}
 
-	// create map tasks
-	var mTasks []MapTask
-	for i := 0; i < MAP_TASKS; i++ {
-		mTasks = append(mTasks, MapTask{M: MAP_TASKS, R: REDUCE_TASKS, N: i, SourceHost: address})
+	var junk Nothing
+	if err := callErr(maddress, "Server.CancelJob", &name, &junk); err != nil {
+		return err
 	}
-	var response LocalResponse
+	fmt.Printf("Job '%s' cancelled\n", name)
+	return nil
+}
+
+// status prints the workers known to the master listening on masterPort, and whether they are blacklisted
+func status(masterPort string) error {
+	masterPortNumber, err := strconv.Atoi(masterPort)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	maddress, err := getLocalAddress(masterPortNumber)
+	if err != nil {
+		return err
+	}
+
+	var workers []WorkerInfo
+	if err := callErr(maddress, "Server.Members", Nothing{}, &workers); err != nil {
+		return err
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Address < workers[j].Address })
+	for _, w := range workers {
+		state := "alive"
+		if !w.Alive {
+			state = "dead"
+		} else if w.Draining {
+			state = "draining"
+		} else if w.Blacklisted {
+			state = "blacklisted"
+		}
+		fmt.Printf("%s: %s, %v slots, %v failed tasks in the last %v, last seen %v ago\n", w.Address, state, w.Slots, len(w.Failures), blacklistWindow, time.Since(w.LastSeen).Round(time.Second))
+	}
+	return nil
+}
+
+// drain asks the master listening on masterPort to take the worker at workerAddress out of service
+func drain(masterPort string, workerAddress string) error {
+	masterPortNumber, err := strconv.Atoi(masterPort)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	maddress, err := getLocalAddress(masterPortNumber)
+	if err != nil {
+		return err
+	}
+
 	var junk Nothing
+	if err := callErr(maddress, "Server.Drain", &workerAddress, &junk); err != nil {
+		return err
+	}
+	fmt.Printf("Draining worker '%s', it quits once nothing it holds is needed\n", workerAddress)
+	return nil
+}
 
-	// send map tasks to actor
-	actor.ExecuteMapTasks(mTasks, &junk)
+// defaultOutput is where the output of a job reading source goes, unless the job says otherwise
+func defaultOutput(source string) string {
+	return filepath.Join(filepath.Dir(source), "ResultsOf-"+filepath.Base(source))
+}
 
-	fmt.Printf("Executing map tasks, waiting for completion\n")
-	// continue to ask until map tasks are finished
-	actor.GetMapTaskFinished(junk, &response)
-	for !response.TasksDone {
-		time.Sleep(1 * time.Second)
-		actor.GetMapTaskFinished(junk, &response)
+// keptJournal reports whether a run that ended with err left a journal in jobdir worth keeping:
+// that of a job that neither succeeded nor was cancelled
+func keptJournal(err error, jobdir string) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
 	}
+	_, statErr := os.Stat(filepath.Join(jobdir, journalFile))
+	return statErr == nil
+}
+
+// defaultJobName names a job after its input file
+func defaultJobName(source string) string {
+	name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	if checkJobName(name) != nil {
+		return "job"
+	}
+	return name
+}
 
-	// start reduce tasks, created from the map tasks, after all map tasks finished
-	actor.ExecuteReduceTasks(&junk, &junk)
+// runJob splits the input of spec, waits for the workers to map and reduce it,
+// and merges the reduce outputs. It returns the name of the output file.
+// The job's files and journal live in tempdir/spec.Name, if a journal is found there the job resumes from it.
+// If the job is cancelled, through CancelJob or ctx, its files are deleted and an error is returned.
+// If a task fails maxTaskFailures times, or anything else goes wrong, the journal is kept and an error is returned.
+func runJob(ctx context.Context, actor Server, client Interface, tempdir string, address string, spec JobSpec) (string, error) {
+	jobdir := filepath.Join(tempdir, spec.Name)
+	os.MkdirAll(jobdir, 0775)
 
-	fmt.Printf("Executing Reduce tasks, waiting for completion\n")
-	actor.GetReduceTaskFinished(junk, &response)
-	for !response.TasksDone {
-		time.Sleep(1 * time.Second)
-		actor.GetReduceTaskFinished(junk, &response)
+	journal, err := openJournal(filepath.Join(jobdir, journalFile))
+	if err != nil {
+		return "", fmt.Errorf("opening journal: %v", err)
 	}
+	defer journal.Close()
+	recorded, splitPoints, resumed, err := journal.job()
+	if err != nil {
+		return "", fmt.Errorf("reading journal: %v", err)
+	}
+	if resumed {
+		// map outputs already in the journal were partitioned by the recorded settings, the job has to keep them
+		if recorded.M != spec.M || recorded.R != spec.R || recorded.Source != spec.Source {
+			return "", fmt.Errorf("job directory %s holds a job splitting %s into %v map tasks and %v reduce tasks", jobdir, recorded.Source, recorded.M, recorded.R)
+		}
+		if recorded.SkipBadRecords != spec.SkipBadRecords || recorded.TotalOrder != spec.TotalOrder || recorded.KeyOrder != spec.KeyOrder {
+			return "", fmt.Errorf("job directory %s holds a job of %s skipping records after %v failures, in total order %v, with key order '%s'", jobdir, recorded.Source, recorded.SkipBadRecords, recorded.TotalOrder, recorded.KeyOrder)
+		}
+		fmt.Printf("Resuming Mapreduce of %s from journal\n", spec.Source)
+	} else {
+		if ctx.Err() != nil {
+			return "", abortJob(jobdir, journal, spec.Name, "")
+		}
+		fmt.Printf("Starting Mapreduce '%s'. Splitting %s into %v map tasks and %v reduce tasks\n", spec.Name, spec.Source, spec.M, spec.R)
 
-	addressList := response.AddressList
+		// split the input into M files
+		_, err = splitDatabase(spec.Source, jobdir, "map_%d_source.db", spec.M)
+		if err != nil {
+			return "", fmt.Errorf("splitting %s: %v", spec.Source, err)
+		}
 
-	fmt.Printf("All MapReduce work done, merging output file\n")
-	// merge reduce files back to one file
-	var mergeList []string
-	for i, v := range addressList {
-		mergeList = append(mergeList, makeURL(v, reduceOutputFile(i)))
+		// in total order mode every reduce task gets a range of keys, so that its output follows the one before.
+		// The split points are journaled, a resumed job has to partition keys the same way
+		if spec.TotalOrder {
+			fmt.Printf("Sampling keys of %s to split them into %v ranges\n", spec.Source, spec.R)
+			splitPoints, err = sampleSplitPoints(ctx, spec, client)
+			if err != nil {
+				return "", fmt.Errorf("sampling %s: %v", spec.Source, err)
+			}
+		}
+		if err := journal.setJob(spec, splitPoints); err != nil {
+			return "", fmt.Errorf("writing journal: %v", err)
+		}
 	}
-	outputFileName := "ResultsOf-" + source_filename
-	mergeDatabases(mergeList, outputFileName, filepath.Join(tempdir, "temp.db"))
 
-	// after merging, shutdown any workers and wait a moment to ensure they close
-	actor.Shutdown(junk, &junk)
-	time.Sleep(1 * time.Second)
+	// hand the tasks to the actor, brought up to date with anything already in the journal
+	replayed, err := actor.startJob(newJob(spec, address, splitPoints), journal)
+	if err != nil {
+		return "", fmt.Errorf("replaying journal: %v", err)
+	}
+	if replayed > 0 {
+		fmt.Printf("Replayed %v events from the journal\n", replayed)
+	}
+	// however runJob returns from here on, the actor forgets the job so its name and workers are free again
+	defer func() {
+		var junk Nothing
+		actor.FinishJob(spec.Name, &junk)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			var junk Nothing
+			actor.CancelJob(spec.Name, &junk)
+		case <-done:
+		}
+	}()
+	var response LocalResponse
+	var junk Nothing
 
-	// Stall for user input before quitting and deleting temp files
-	fmt.Printf("'%s' created. Press enter to delete all temp data in: %s", outputFileName, tempdir)
-	scanner.Scan()
+	// reduce tasks are handed out straight away, they fetch each map output as soon as it is ready
+	actor.ExecuteReduceTasks(spec.Name, &junk)
 
-	return nil
+	fmt.Printf("Executing map tasks of '%s', waiting for completion\n", spec.Name)
+	// continue to wait until map tasks are finished
+	actor.WaitForPhase(Phase{Job: spec.Name, WorkType: 1}, &response)
+	for !response.TasksDone && !response.Aborted {
+		actor.WaitForPhase(Phase{Job: spec.Name, WorkType: 1}, &response)
+	}
+	if response.Aborted {
+		return "", abortJob(jobdir, journal, spec.Name, response.Failed)
+	}
+
+	outputFileName := spec.Output
+	if outputFileName == "" {
+		outputFileName = defaultOutput(spec.Source)
+	}
+	for {
+		fmt.Printf("Executing Reduce tasks of '%s', waiting for completion\n", spec.Name)
+		actor.WaitForPhase(Phase{Job: spec.Name, WorkType: 2}, &response)
+		for !response.TasksDone && !response.Aborted {
+			actor.WaitForPhase(Phase{Job: spec.Name, WorkType: 2}, &response)
+		}
+		if response.Aborted {
+			return "", abortJob(jobdir, journal, spec.Name, response.Failed)
+		}
+
+		fmt.Printf("All MapReduce work on '%s' done, merging output file\n", spec.Name)
+		// merge reduce files back to one file, next to the input, from any worker holding a copy
+		var holders [][]string
+		for i, v := range response.AddressList {
+			holders = append(holders, append([]string{v}, response.Replicas[i]...))
+		}
+		err := mergeOutputs(spec.Name, holders, outputFileName, filepath.Join(jobdir, "temp.db"))
+		if lost, ok := err.(*FetchError); ok {
+			// every copy of the output is gone, run the reduce task again and wait for it
+			fmt.Printf("No copy of the output of reduce task #%v of '%s' could be fetched, running it again\n", lost.Index, spec.Name)
+			actor.ReduceOutputLost(Completion{Job: spec.Name, WorkType: 2, TaskID: lost.Index}, &junk)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("merging output of '%s': %v", spec.Name, err)
+		}
+		break
+	}
+	// with a key order the output is sorted by key, in total order mode the reduce outputs already follow each other
+	if less := keyLess(client, spec.KeyOrder); less != nil && !spec.TotalOrder {
+		fmt.Printf("Sorting output of '%s' by key\n", spec.Name)
+		if err := sortDatabase(outputFileName, filepath.Join(jobdir, "temp.db"), less); err != nil {
+			return "", fmt.Errorf("sorting output of '%s': %v", spec.Name, err)
+		}
+	}
+
+	return outputFileName, nil
+}
+
+// mergeOutputs merges the reduce outputs of job into output, fetching each one from the first of its holders
+// that can be reached. A FetchError is returned for an output that could not be fetched from any of them.
+func mergeOutputs(job string, holders [][]string, output string, temp string) error {
+	next := make([]int, len(holders))
+	for {
+		var urls []string
+		for i := range holders {
+			urls = append(urls, makeURL(holders[i][next[i]], jobFile(job, reduceOutputFile(i))))
+		}
+		_, err := mergeDatabases(urls, output, temp)
+		fetchErr, ok := err.(*FetchError)
+		if !ok {
+			return err
+		}
+		fmt.Printf("Could not fetch output of reduce task #%v: %v\n", fetchErr.Index, fetchErr.Err)
+		next[fetchErr.Index]++
+		if next[fetchErr.Index] >= len(holders[fetchErr.Index]) {
+			return fetchErr
+		}
+	}
+}
+
+// abortJob closes the journal of a cancelled or failed job, deleting its files if it was cancelled.
+// failure is the reason the job failed, or empty if it was cancelled. A failed job's
+// journal is kept, to look into why it failed or to resume the job from.
+func abortJob(jobdir string, journal *journal, name string, failure string) error {
+	journal.Close()
+	var err error
+	if failure != "" {
+		err = fmt.Errorf("job '%s' failed: %s", name, failure)
+		fmt.Printf("%v, keeping its journal in %s\n", err, jobdir)
+	} else {
+		err = fmt.Errorf("job '%s' was cancelled", name)
+		fmt.Printf("%v, deleting %s\n", err, jobdir)
+		os.RemoveAll(jobdir)
+	}
+	return err
 }
 
-func worker(client Interface, portNumber string, masterPort string) error {
+func worker(client Interface, portNumber string, masterPort string, task_slots string) error {
 	// collect arguments into int values
 	masterPortNumber, err := strconv.Atoi(masterPort)
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
+	SLOTS, err := strconv.Atoi(task_slots)
+	if err != nil || SLOTS < 1 {
+		log.Fatalf("invalid number of task slots '%s'\n", task_slots)
+	}
 
 	PORT, err := strconv.Atoi(portNumber)
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
 
-	//setup tempdir and http server
+	//setup tempdir
 	tempdir := filepath.Join(os.TempDir(), fmt.Sprintf("mapreduce.%d", os.Getpid()))
 	os.RemoveAll(tempdir)
 	os.Mkdir(tempdir, 0775)
 	defer os.RemoveAll(tempdir)
-	address := getLocalAddress(PORT)
-	maddress := getLocalAddress(masterPortNumber)
+	address, err := getLocalAddress(PORT)
+	if err != nil {
+		return err
+	}
+	maddress, err := getLocalAddress(masterPortNumber)
+	if err != nil {
+		return err
+	}
+	config := WorkerConfig{Client: client, Port: PORT, Address: address, Master: maddress, Slots: SLOTS, TempDir: tempdir}
+
+	// on SIGTERM ask the master to drain us, a second SIGTERM kills the worker straight away
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Reset(syscall.SIGTERM)
+		fmt.Printf("Received SIGTERM, draining\n")
+		var junk Nothing
+		if err := callErr(config.Master, "Server.Drain", &config.Address, &junk); err != nil {
+			log.Printf("drain failed: %v\n", err)
+		}
+	}()
 
-	l, e := net.Listen("tcp", fmt.Sprintf(":%v", PORT))
-	if e != nil {
-		log.Fatal("listen error:", e)
+	drained, err := runWorker(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	if drained {
+		fmt.Printf("Worker drained, nothing it holds is needed any more, quitting\n")
+		return nil
 	}
-	http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
-	go http.Serve(l, nil)
+	fmt.Printf("Master indicated Mapreduce job completed, Press enter to delete temp files and quit")
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	return nil
+}
+
+// runWorker is RunWorker, also reporting whether the worker was let go after a drain
+func runWorker(ctx context.Context, config WorkerConfig) (bool, error) {
+	if config.Client == nil {
+		return false, errors.New("no client to run Map and Reduce")
+	}
+	if config.Master == "" {
+		return false, errors.New("no master to ask for work")
+	}
+	if config.Slots == 0 {
+		config.Slots = runtime.NumCPU()
+	} else if config.Slots < 0 {
+		return false, fmt.Errorf("invalid number of task slots %v", config.Slots)
+	}
+	if config.Address == "" {
+		var err error
+		if config.Address, err = getLocalAddress(config.Port); err != nil {
+			return false, err
+		}
+	}
+	tempdir := config.TempDir
+	if tempdir == "" {
+		var err error
+		tempdir, err = ioutil.TempDir("", "mapreduce.")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(tempdir)
+	} else if err := os.MkdirAll(tempdir, 0775); err != nil {
+		return false, err
+	}
+	address, maddress := config.Address, config.Master
+
+	//setup http server
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", config.Port))
+	if err != nil {
+		return false, fmt.Errorf("listen error: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+	defer server.Close()
 
 	fmt.Printf("Started fileserver with address: %s\n", address)
 	fmt.Printf("TEMP DIR: %s\n", tempdir)
-	fmt.Printf("Waiting for work...\n")
 
-	for {
-		var response Response
-		err = callErr(maddress, "Server.GetWork", &address, &response)
-		if err != nil {
-			log.Fatalf("%v\n", err)
+	// join the cluster and keep telling the master we are alive
+	reg := Registration{Address: address, Slots: config.Slots}
+	var junk Response
+	if err := callRetry(maddress, "Server.Register", &reg, &junk); err != nil {
+		return false, err
+	}
+	tasks := &inflight{tempdir: tempdir, slots: make(chan struct{}, config.Slots)}
+	// a worker that can see the master's job directory reads map inputs in place
+	if marker, err := ioutil.ReadFile(filepath.Join(junk.Root, rootMarker)); err == nil && string(marker) == maddress {
+		fmt.Printf("Sharing the master's job directory %s, map inputs are read in place\n", junk.Root)
+		reg.Shared = true
+		// let the master know before asking for work
+		if err := callRetry(maddress, "Server.Heartbeat", &reg, &junk); err != nil {
+			return false, err
 		}
-		if response.WorkType != 0 { // If there is work to do
-			if response.WorkType == 1 { // map
-				response.Maptask.Process(tempdir, client)
-			} else if response.WorkType == 2 { // reduce
-				response.Reducetask.Process(tempdir, client)
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go heartbeat(ctx, maddress, reg, tasks)
+	fmt.Printf("Waiting for work, running up to %v tasks at a time...\n", config.Slots)
+
+	// every slot asks for work on its own, the master keeps us within Slots tasks
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var drained bool
+	var firstErr error
+	for i := 0; i < config.Slots; i++ {
+		wg.Add(1)
+		go func() {
+			slotDrained, err := work(ctx, config.Client, tempdir, address, maddress, tasks)
+			mu.Lock()
+			drained = drained || slotDrained
+			if firstErr == nil {
+				firstErr = err
 			}
-			var response Response
-			err = callErr(maddress, "Server.FinishedWork", &address, &response)
+			mu.Unlock()
 			if err != nil {
-				log.Fatalf("%v\n", err)
+				// the master is unreachable, stop the other slots too
+				stop()
 			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	tasks.shuffles.Wait()
+
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return drained, nil
+}
 
+// work runs tasks from the master one after another, until the master shuts down, ctx is cancelled,
+// or the master lets the worker go after a drain, in which case it returns true
+func work(ctx context.Context, client Interface, tempdir string, address string, maddress string, tasks *inflight) (bool, error) {
+	for ctx.Err() == nil {
+		var response Response
+		err := callRetry(maddress, "Server.GetWork", &address, &response)
+		if err != nil {
+			return false, err
+		}
+		tasks.cancelJobs(response.Cancelled)
+		tasks.finishJobs(response.Finished)
+		if response.WorkType == 2 && !response.Reducetask.ready() {
+			// the map phase is still running, shuffle in the background and let this slot take other work
+			tasks.shuffles.Add(1)
+			go func(response Response) {
+				if err := runTask(ctx, client, tempdir, address, maddress, tasks, response); err != nil {
+					log.Printf("%v\n", err)
+				}
+				tasks.shuffles.Done()
+			}(response)
+		} else if response.WorkType != 0 { // If there is work to do
+			if err := runTask(ctx, client, tempdir, address, maddress, tasks, response); err != nil {
+				return false, err
+			}
+		} else if response.Drained { // the master let us go after a drain
+			return true, nil
 		} else if response.Shutdown { // If no work, check if shutting down
-			fmt.Printf("Master indicated Mapreduce job completed, Press enter to delete temp files and quit")
-			scanner := bufio.NewScanner(os.Stdin)
-			scanner.Scan()
-			return nil
+			return false, nil
+		}
+		// GetWork waits on the master until there is work, so ask again straight away
+	}
+	return false, ctx.Err()
+}
+
+// runTask processes a task handed out by the master and reports how it went.
+// An error is returned if the report could not reach the master.
+func runTask(ctx context.Context, client Interface, tempdir string, address string, maddress string, tasks *inflight, response Response) error {
+	job := response.Maptask.Job
+	if response.WorkType == 2 {
+		job = response.Reducetask.Job
+	} else if response.WorkType == 3 {
+		job = response.Replica.Job
+	}
+	report := Completion{Address: address, Job: job, WorkType: response.WorkType, TaskID: response.TaskID, Attempt: response.Attempt}
+	ctx, id := tasks.start(ctx, report)
+	var taskErr error
+	if response.WorkType == 1 { // map
+		taskErr = tasks.process(ctx, func() error { return response.Maptask.Process(ctx, tempdir, client) })
+	} else if response.WorkType == 2 { // reduce
+		// fetch the map outputs as their map tasks complete, then reduce
+		outputs := func(have []string) ([]string, error) {
+			query := ShuffleQuery{Completion: report, Have: have}
+			var status ShuffleStatus
+			if err := callRetry(maddress, "Server.MapOutputs", &query, &status); err != nil {
+				return nil, err
+			}
+			if status.Stale {
+				return nil, errStale
+			}
+			return status.SourceHosts, nil
+		}
+		taskErr = response.Reducetask.Shuffle(ctx, tempdir, outputs)
+		if taskErr == nil {
+			// a reduce that shuffled in the background waits for a slot like any other task
+			taskErr = tasks.process(ctx, func() error { return response.Reducetask.Process(ctx, tempdir, client) })
+		}
+	} else if response.WorkType == 3 { // copy a reduce output
+		taskErr = tasks.process(ctx, func() error { return response.Replica.Process(ctx, tempdir) })
+	}
+	dropped := ctx.Err() != nil
+	tasks.finish(id)
+	if dropped {
+		// the job was cancelled, or the master took the attempt back, there is nothing to report
+		fmt.Printf("Dropped task #%v of '%s', its job was cancelled or the master took it back\n", response.TaskID, job)
+	} else if response.WorkType == 3 && taskErr != nil {
+		// the master gives up on the copy once its time is up
+		fmt.Printf("Could not copy output of reduce task #%v of '%s': %v\n", response.TaskID, job, taskErr)
+	} else if taskErr == errStale {
+		// the master gave up on the attempt while it waited for map outputs
+		fmt.Printf("Reduce task #%v of '%s' is no longer wanted, dropped it\n", response.TaskID, job)
+	} else if fetchErr, ok := taskErr.(*FetchError); ok {
+		// a map output could not be downloaded, let the master reschedule that map task
+		fmt.Printf("Could not fetch output of map task #%v: %v\n", fetchErr.Index, fetchErr.Err)
+		failure := FetchFailure{Completion: report, MapTask: fetchErr.Index, URL: fetchErr.URL}
+		var response Response
+		return callRetry(maddress, "Server.FetchFailed", &failure, &response)
+	} else if taskErr != nil {
+		// the task failed, tell the master why so it can run it again elsewhere
+		fmt.Printf("Task failed: %v\n", taskErr)
+		failure := Failure{Completion: report, Error: taskErr.Error()}
+		if recordErr, ok := taskErr.(*RecordError); ok {
+			failure.Record = recordErr.Key
+		}
+		var response Response
+		return callRetry(maddress, "Server.FailedWork", &failure, &response)
+	} else {
+		var response Response
+		return callRetry(maddress, "Server.FinishedWork", &report, &response)
+	}
+	return nil
+}
+
+// heartbeat pings the master every heartbeatInterval so it knows this worker is still alive, which
+// attempts it is still working on and which map inputs it holds, stops any tasks whose job the master says was cancelled
+// or whose attempt it revoked, and deletes the files of jobs that are over. It stops once ctx is cancelled.
+func heartbeat(ctx context.Context, maddress string, reg Registration, tasks *inflight) {
+	for ctx.Err() == nil {
+		reg.Inputs = tasks.inputs()
+		reg.Running = tasks.attempts()
+		var response Response
+		if err := callErr(maddress, "Server.Heartbeat", &reg, &response); err != nil {
+			log.Printf("heartbeat failed: %v\n", err)
+		} else {
+			tasks.cancelJobs(response.Cancelled)
+			tasks.finishJobs(response.Finished)
+			tasks.revoke(response.Revoked)
+		}
+		select {
+		case <-time.After(heartbeatInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// inflight tracks the tasks a worker is processing, so they can be stopped when their job is cancelled
+type inflight struct {
+	sync.Mutex
+	shuffles  sync.WaitGroup // reduce tasks shuffling in the background
+	slots     chan struct{}  // one token per task processing, so no more than Slots run at once
+	tempdir   string
+	next      int
+	running   map[int]runningTask
+	cancelled map[string]bool
+	over      map[string]bool // jobs the master finished with
+}
+
+type runningTask struct {
+	job     string
+	attempt Completion
+	cancel  context.CancelFunc
+}
+
+// start registers an attempt at a task, the returned context is cancelled if its job or parent is
+func (t *inflight) start(parent context.Context, attempt Completion) (context.Context, int) {
+	t.Lock()
+	defer t.Unlock()
+	if t.running == nil {
+		t.running = make(map[int]runningTask)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	if t.cancelled[attempt.Job] {
+		cancel()
+	}
+	t.next++
+	t.running[t.next] = runningTask{job: attempt.Job, attempt: attempt, cancel: cancel}
+	return ctx, t.next
+}
+
+// process runs a task once one of the worker's slots is free. Reduce tasks that shuffled in the background
+// run outside the slots that ask for work, without this they could run on top of a task in every slot.
+func (t *inflight) process(ctx context.Context, run func() error) error {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-t.slots }()
+	return run()
+}
+
+// finish forgets a task, deleting its job's files if the job was cancelled or is over and nothing else is using them
+func (t *inflight) finish(id int) {
+	t.Lock()
+	defer t.Unlock()
+	task := t.running[id]
+	task.cancel()
+	delete(t.running, id)
+	if (t.cancelled[task.job] || t.over[task.job]) && !t.busy(task.job) {
+		os.RemoveAll(filepath.Join(t.tempdir, task.job))
+	}
+}
+
+// cancelJobs stops the running tasks of every job in names, and deletes the files of those jobs
+func (t *inflight) cancelJobs(names []string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.cancelled == nil {
+		t.cancelled = make(map[string]bool)
+	}
+	current := make(map[string]bool)
+	for _, job := range names {
+		current[job] = true
+		if t.cancelled[job] {
+			continue
+		}
+		t.cancelled[job] = true
+		for _, task := range t.running {
+			if task.job == job {
+				task.cancel()
+			}
+		}
+		if !t.busy(job) {
+			os.RemoveAll(filepath.Join(t.tempdir, job))
+		}
+	}
+	// a name that is no longer cancelled has been reused for a new job
+	for job := range t.cancelled {
+		if !current[job] {
+			delete(t.cancelled, job)
+		}
+	}
+}
+
+// finishJobs deletes the files of every job in names, which the master no longer needs.
+// The files of a job that still has a task running are deleted once the last one finishes.
+func (t *inflight) finishJobs(names []string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.over == nil {
+		t.over = make(map[string]bool)
+	}
+	current := make(map[string]bool)
+	for _, job := range names {
+		current[job] = true
+		if t.over[job] {
+			continue
+		}
+		t.over[job] = true
+		if !t.busy(job) {
+			os.RemoveAll(filepath.Join(t.tempdir, job))
+		}
+	}
+	// a name that is no longer over has been reused for a new job
+	for job := range t.over {
+		if !current[job] {
+			delete(t.over, job)
+		}
+	}
+}
+
+// revoke stops the attempts the master no longer wants from this worker
+func (t *inflight) revoke(attempts []Completion) {
+	t.Lock()
+	defer t.Unlock()
+	for _, attempt := range attempts {
+		for _, task := range t.running {
+			if task.attempt == attempt {
+				fmt.Printf("Attempt %v of task #%v of '%s' was revoked, stopping it\n", attempt.Attempt, attempt.TaskID, attempt.Job)
+				task.cancel()
+			}
 		}
-		// sleep a second inbetween requests
-		time.Sleep(1 * time.Second)
 	}
 }
 
+// attempts lists the attempts the worker is working on
+func (t *inflight) attempts() []Completion {
+	t.Lock()
+	defer t.Unlock()
+	var attempts []Completion
+	for _, task := range t.running {
+		attempts = append(attempts, task.attempt)
+	}
+	return attempts
+}
+
+// inputs lists the map inputs held by the worker, relative to its job directory
+func (t *inflight) inputs() []string {
+	paths, _ := filepath.Glob(filepath.Join(t.tempdir, "*", "map_*_input.db"))
+	var inputs []string
+	for _, p := range paths {
+		if rel, err := filepath.Rel(t.tempdir, p); err == nil {
+			inputs = append(inputs, filepath.ToSlash(rel))
+		}
+	}
+	return inputs
+}
+
+// busy reports whether a task of job is running, the caller must hold the lock
+func (t *inflight) busy(job string) bool {
+	for _, task := range t.running {
+		if task.job == job {
+			return true
+		}
+	}
+	return false
+}
+
 func openDatabase(path string) (*sql.DB, error) {
 	options :=
 		"?" + "_busy_timeout=10000" +
@@ -187,9 +1034,8 @@ func openDatabase(path string) (*sql.DB, error) {
 			"&" + "_locking_mode=NORMAL" +
 			"&" + "mode=rw" +
 			"&" + "_synchronous=OFF"
-	db, err := sql.Open("sqlite3", path+options)
+	db, err := sql.Open(driverName, path+options)
 	if err != nil {
-		log.Fatalf("%v", err)
 		return nil, err
 	}
 	return db, nil
@@ -205,7 +1051,6 @@ func createDatabase(path string) (*sql.DB, error) {
 	// create file
 	file, err := os.Create(path)
 	if err != nil {
-		log.Fatalf("%v", err)
 		return nil, err
 	}
 	file.Close()
@@ -213,12 +1058,10 @@ func createDatabase(path string) (*sql.DB, error) {
 	// open database as file just created
 	db, err := openDatabase(path)
 	if err != nil {
-		log.Fatalf("%v", err)
 		return nil, err
 	}
 	_, err = db.Exec("create table pairs (key text, value text);")
 	if err != nil {
-		log.Fatalf("%v", err)
 		db.Close()
 		return nil, err
 	}
@@ -230,10 +1073,8 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 	// open input database
 	db, err := openDatabase(source)
 	if err != nil {
-		log.Fatalf("%v", err)
 		return nil, err
 	}
-	defer db.Close()
 
 	// create databases slice
 	var dbs []*sql.DB
@@ -244,7 +1085,7 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 		pathnames = append(pathnames, dbfile)
 		tdb, err := createDatabase(dbfile)
 		if err != nil {
-			log.Fatalf("%v", err)
+			splitDatabaseCloser(db, dbs)
 			return nil, err
 		}
 		dbs = append(dbs, tdb)
@@ -255,20 +1096,18 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 	log.Printf("source: %s\n", source)
 	rows, err := db.Query("select count(1) from pairs")
 	if err != nil {
-		log.Fatalf("%v", err)
+		splitDatabaseCloser(db, dbs)
 		return nil, err
 	}
 	for rows.Next() {
 		var count string
 		err = rows.Scan(&count)
 		if err != nil {
-			log.Fatalf("%v", err)
 			splitDatabaseCloser(db, dbs)
 			return nil, err
 		}
 		totalRows, err = strconv.Atoi(count)
 		if err != nil {
-			log.Fatalf("%v", err)
 			splitDatabaseCloser(db, dbs)
 			return nil, err
 		}
@@ -276,11 +1115,14 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 
 	// creating 10 percent of total rows to check against total
 	totalRows10 := totalRows / 10
+	if totalRows10 == 0 {
+		totalRows10 = 1
+	}
 
 	// create rows from input
 	rows, err = db.Query("select key, value from pairs")
 	if err != nil {
-		log.Fatalf("%v", err)
+		splitDatabaseCloser(db, dbs)
 		return nil, err
 	}
 
@@ -299,7 +1141,6 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 		var value string
 		err = rows.Scan(&key, &value)
 		if err != nil {
-			log.Fatalf("%v", err)
 			splitDatabaseCloser(db, dbs)
 			return nil, err
 		}
@@ -307,7 +1148,6 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 		// process the result
 		_, err := dbs[index].Exec("insert into pairs (key, value) values (?,?)", key, value)
 		if err != nil {
-			log.Fatalf("%v", err)
 			splitDatabaseCloser(db, dbs)
 			return nil, err
 		}
@@ -320,7 +1160,6 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 		}
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatalf("%v", err)
 		splitDatabaseCloser(db, dbs)
 		return nil, err
 	}
@@ -343,24 +1182,95 @@ func splitDatabaseCloser(db *sql.DB, dbs []*sql.DB) {
 	}
 }
 
+// sampleSplitPoints picks spec.R-1 keys that split the keys of the job into ranges of about the same size,
+// from a sample of samplesPerReduce input records per range. With a client, the keys its Map outputs for
+// the sample are used, or their group keys for a Grouper, otherwise the records' own keys.
+func sampleSplitPoints(ctx context.Context, spec JobSpec, client Interface) ([]string, error) {
+	db, err := openDatabase(spec.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var totalRows int
+	if err := db.QueryRow("select count(1) from pairs").Scan(&totalRows); err != nil {
+		return nil, err
+	}
+	step := totalRows / (samplesPerReduce * spec.R)
+	if step < 1 {
+		step = 1
+	}
+	rows, err := db.Query("select key, value from pairs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Pair
+	for row := 0; rows.Next(); row++ {
+		if row%step != 0 {
+			continue
+		}
+		var pair Pair
+		if err := rows.Scan(&pair.Key, &pair.Value); err != nil {
+			return nil, err
+		}
+		records = append(records, pair)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var sample []string
+	group := groupKey(client)
+	if client == nil {
+		for _, record := range records {
+			sample = append(sample, record.Key)
+		}
+	} else {
+		// the client sees the sample as a map task numbered -1
+		ctx := taskContext(ctx, TaskInfo{Job: spec.Name, WorkType: 1, N: -1, M: spec.M, R: spec.R})
+		for _, record := range records {
+			pairChan := make(chan Pair, 100)
+			finished := make(chan []string, 1)
+			go func() {
+				var keys []string
+				for pair := range pairChan {
+					keys = append(keys, group(pair.Key))
+				}
+				finished <- keys
+			}()
+			// records Map fails on are left out, the map tasks report them
+			panicked, _ := callMap(ctx, client, record.Key, record.Value, pairChan, true)
+			keys := <-finished
+			if !panicked {
+				sample = append(sample, keys...)
+			}
+		}
+	}
+
+	sortKeys(sample, keyLess(client, spec.KeyOrder))
+	var points []string
+	for i := 1; i < spec.R && len(sample) > 0; i++ {
+		points = append(points, sample[i*len(sample)/spec.R])
+	}
+	return points, nil
+}
+
 func mergeDatabases(urls []string, path string, temp string) (*sql.DB, error) {
 	// open new database with path
 	db, err := createDatabase(path)
-	defer db.Close()
 	if err != nil {
-		log.Fatalf("%v", err)
 		return nil, err
 	}
+	defer db.Close()
 
 	// for every url in urls, download the file and merge into db
 	for i := range urls {
 		if err := download(urls[i], temp); err != nil {
-			log.Fatalf("%v", err)
-			return nil, err
+			return nil, &FetchError{Index: i, URL: urls[i], Err: err}
 		}
 		time.Sleep(1 * time.Second)
 		if err := gatherInto(db, temp); err != nil {
-			log.Fatalf("%v", err)
 			return nil, err
 		}
 	}
@@ -368,24 +1278,70 @@ func mergeDatabases(urls []string, path string, temp string) (*sql.DB, error) {
 	return db, nil
 }
 
+// download fetches url into path. It writes next to path first, so path never holds a partial file.
 func download(url, path string) error {
-	out, err := os.Create(path)
+	out, err := os.Create(path + ".part")
 	if err != nil {
-		log.Fatalf("%v", err)
 		return err
 	}
+	defer os.Remove(path + ".part")
 	defer out.Close()
 
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatalf("%v", err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
 
-	_, err = io.Copy(out, resp.Body)
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".part", path)
+}
 
-	return err
+// errStale is returned by a shuffling reduce task that the master no longer wants
+var errStale = errors.New("the master gave up on the attempt")
+
+// FetchError (Index, URL, Err)
+type FetchError struct {
+	Index int    // position of the failed url in the list passed to mergeDatabases
+	URL   string // url that could not be downloaded
+	Err   error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.URL, e.Err)
+}
+
+// sortDatabase rewrites the database at path with its pairs in key order, going through temp
+func sortDatabase(path string, temp string, less func(a, b string) bool) error {
+	collation, release := registerCollation(less)
+	defer release()
+	db, err := createDatabase(temp)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("attach ? as unsorted;", path); err != nil {
+		return err
+	}
+	if _, err := db.Exec("insert into pairs select key, value from unsorted.pairs order by key collate " + collation + ", key;"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("detach unsorted;"); err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
 }
 
 func gatherInto(db *sql.DB, path string) error {
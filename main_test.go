@@ -0,0 +1,159 @@
+package mapreduce
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// wordCount counts the words of its input values
+type wordCount struct{}
+
+func (wordCount) Map(key, value string, output chan<- Pair) error {
+	defer close(output)
+	for _, word := range strings.Fields(value) {
+		output <- Pair{Key: strings.ToLower(word), Value: "1"}
+	}
+	return nil
+}
+
+func (wordCount) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	count := 0
+	for value := range values {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+	output <- Pair{Key: key, Value: strconv.Itoa(count)}
+	return nil
+}
+
+// freePort returns a port nothing listens on at the moment
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestWordCount(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	lines := []string{"the quick brown fox", "jumps over the lazy dog", "The dog sleeps", "a fox and a dog", "quick quick"}
+	var input []Pair
+	for i, line := range lines {
+		input = append(input, Pair{Key: strconv.Itoa(i), Value: line})
+	}
+	source := filepath.Join(tempdir, "lines.db")
+	writePairs(t, source, input)
+
+	masterPort, workerPort := freePort(t), freePort(t)
+	master := "127.0.0.1:" + strconv.Itoa(masterPort)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	workerDone := make(chan error, 1)
+	go func() {
+		workerDone <- RunWorker(ctx, WorkerConfig{Client: wordCount{}, Port: workerPort, Address: "127.0.0.1:" + strconv.Itoa(workerPort), Master: master, Slots: 2, TempDir: filepath.Join(tempdir, "worker")})
+	}()
+
+	config := MasterConfig{Port: masterPort, Address: master, Input: source, M: 3, R: 2, TempDir: filepath.Join(tempdir, "master")}
+	if err := RunMaster(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-workerDone; err != nil {
+		t.Errorf("worker: %v", err)
+	}
+
+	counts := make(map[string]string)
+	for _, pair := range readPairs(t, filepath.Join(tempdir, "ResultsOf-lines.db")) {
+		counts[pair.Key] = pair.Value
+	}
+	want := map[string]string{"the": "3", "quick": "3", "brown": "1", "fox": "2", "jumps": "1", "over": "1", "lazy": "1", "dog": "3", "sleeps": "1", "a": "2", "and": "1"}
+	if len(counts) != len(want) {
+		t.Errorf("got %v words, want %v: %v", len(counts), len(want), counts)
+	}
+	for word, n := range want {
+		if counts[word] != n {
+			t.Errorf("count of %q is %q, want %q", word, counts[word], n)
+		}
+	}
+
+	// the job's own files are gone, the directory it was given is not
+	if _, err := os.Stat(filepath.Join(config.TempDir, "lines")); !os.IsNotExist(err) {
+		t.Errorf("job directory left behind: %v", err)
+	}
+	if _, err := os.Stat(config.TempDir); err != nil {
+		t.Errorf("master's TempDir was deleted: %v", err)
+	}
+}
+
+func TestResumeRefusesAJobPartitionedDifferently(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	spec := JobSpec{Name: "job", Source: "input.db", M: 2, R: 2, TotalOrder: true, KeyOrder: "numeric"}
+	os.MkdirAll(filepath.Join(tempdir, spec.Name), 0775)
+	j, err := openJournal(filepath.Join(tempdir, spec.Name, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.setJob(spec, []string{"10"}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	actor, stop := startMActor()
+	defer stop()
+	for _, changed := range []JobSpec{
+		{Name: "job", Source: "input.db", M: 2, R: 2, KeyOrder: "numeric"},
+		{Name: "job", Source: "input.db", M: 2, R: 2, TotalOrder: true},
+		{Name: "job", Source: "input.db", M: 2, R: 2, TotalOrder: true, KeyOrder: "numeric", SkipBadRecords: 2},
+		{Name: "job", Source: "input.db", M: 3, R: 2, TotalOrder: true, KeyOrder: "numeric"},
+	} {
+		if _, err := runJob(context.Background(), actor, nil, tempdir, "master:1", changed); err == nil || !strings.Contains(err.Error(), "holds a job") {
+			t.Errorf("resuming as %+v: got %v, want the job directory refused", changed, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, spec.Name, journalFile)); err != nil {
+		t.Errorf("journal was lost: %v", err)
+	}
+}
+
+func TestInflightProcessKeepsToTheWorkersSlots(t *testing.T) {
+	tasks := &inflight{slots: make(chan struct{}, 1)}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tasks.process(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	if err := tasks.process(ctx, func() error { ran = true; return nil }); err != context.Canceled || ran {
+		t.Fatalf("a second task ran while the only slot was taken: %v", err)
+	}
+	close(release)
+	if err := tasks.process(context.Background(), func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("task did not run once the slot was free: %v", err)
+	}
+}
@@ -18,7 +18,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := mapreduce.Start(c, dir, INPUT_FILE_NAME); err != nil {
+	if err := mapreduce.Start(c, filepath.Join(dir, INPUT_FILE_NAME)); err != nil {
 		log.Fatalf("%v", err)
 	}
 }
@@ -44,6 +44,11 @@ func (c Client) Map(key, value string, output chan<- mapreduce.Pair) error {
 	return nil
 }
 
+// Combine sums the counts of a map task before they are shuffled, which is just what Reduce does
+func (c Client) Combine(key string, values <-chan string, output chan<- mapreduce.Pair) error {
+	return c.Reduce(key, values, output)
+}
+
 func (c Client) Reduce(key string, values <-chan string, output chan<- mapreduce.Pair) error {
 	defer close(output)
 	count := 0
@@ -2,12 +2,57 @@ package mapreduce
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"time"
 )
 
+// how long a worker may hold a task before it is handed to someone else
+const taskLease = 2 * time.Minute
+
+// fraction of a phase that must be completed before idle workers are given
+// backup copies of the slowest tasks still in progress
+const speculateAfter = 0.75
+
+// number of input keys sampled for each reduce task in total order mode
+const samplesPerReduce = 100
+
+// how often workers send a heartbeat, and how long the master waits
+// without hearing from a worker before it is considered dead
+const (
+	heartbeatInterval = 5 * time.Second
+	heartbeatTimeout  = 3 * heartbeatInterval
+)
+
+// number of extra copies of each reduce output kept on other workers,
+// so the final merge can still fetch it if the reducer leaves
+const reduceReplicas = 1
+
+// name of the file in the master's job directory holding its address, a worker that can read
+// it shares the master's filesystem and opens map inputs in place instead of downloading them
+const rootMarker = "master.addr"
+
+// how long GetWork and WaitForPhase block before returning with nothing to report
+const longPollTimeout = 10 * time.Second
+
+// how many attempts of a task may fail before its whole job is failed
+const maxTaskFailures = 4
+
+// a worker that fails this many tasks within blacklistWindow is given no more work,
+// until its failures are older than the window
+const (
+	blacklistFailures = 3
+	blacklistWindow   = 10 * time.Minute
+)
+
+// how long workers keep retrying a call to the master, long enough to ride out a master restart
+const masterRetryTimeout = 1 * time.Minute
+
 // Nothing ()
 type Nothing struct{}
 
@@ -16,24 +61,140 @@ type Response struct {
 	Message    string
 	Maptask    MapTask
 	Reducetask ReduceTask
-	WorkType   int // 0 for no work, 1 for mapping, 2 for reducing
+	Replica    ReplicaTask
+	WorkType   int          // 0 for no work, 1 for mapping, 2 for reducing, 3 for copying a reduce output
+	TaskID     int          // number of the map or reduce task handed out
+	Attempt    int          // attempt number of the task, starting at 1
+	Cancelled  []string     // jobs that were cancelled, workers drop any work on them
+	Finished   []string     // jobs whose output has been merged, workers delete their files
+	Revoked    []Completion // attempts the worker reported that are no longer its to run, it stops them
 	Shutdown   bool
+	Drained    bool   // the worker was drained and nothing it holds is needed any more, it may exit
+	Root       string // the master's job directory, in reply to Register
+}
+
+// Registration (Address, Slots, Shared, Inputs, Running)
+type Registration struct {
+	Address string
+	Slots   int          // number of tasks the worker runs at once
+	Shared  bool         // the worker can read the master's job directory in place
+	Inputs  []string     // map inputs the worker holds, relative to its job directory
+	Running []Completion // attempts the worker is still working on, their leases are renewed
+}
+
+// Completion (Address, Job, WorkType, TaskID, Attempt)
+type Completion struct {
+	Address  string
+	Job      string
+	WorkType int // 1 for mapping, 2 for reducing
+	TaskID   int
+	Attempt  int
 }
 
 type LocalResponse struct {
 	TasksDone   bool
+	Aborted     bool
+	Failed      string // why the job failed, empty unless a task failed too often
 	AddressList []string
+	Replicas    [][]string // other workers holding a copy of each reduce output
+}
+
+// FetchFailure (Completion, MapTask, URL)
+type FetchFailure struct {
+	Completion        // the reduce attempt that could not fetch its input
+	MapTask    int    // map task whose output was unreachable
+	URL        string // url the reducer tried to download
+}
+
+// Failure (Completion, Error, Record)
+type Failure struct {
+	Completion        // the attempt that failed
+	Error      string // why it failed
+	Record     string // key of the input record Map failed on, in skip mode
+}
+
+// ShuffleQuery (Completion, Have)
+type ShuffleQuery struct {
+	Completion          // the reduce attempt that is shuffling
+	Have       []string // url of each map output the reducer has fetched, empty for the rest
+}
+
+// ShuffleStatus (SourceHosts, Stale)
+type ShuffleStatus struct {
+	SourceHosts []string // url of each map task's output, empty for map tasks not completed yet
+	Stale       bool     // the reduce attempt is no longer running, it should stop
+}
+
+// WorkerInfo (Address, Slots, Joined, LastSeen, Alive, Failures, Blacklisted, Draining)
+type WorkerInfo struct {
+	Address     string
+	Slots       int       // number of tasks the worker runs at once, 0 until it registers
+	Joined      time.Time // when the worker first contacted the master
+	LastSeen    time.Time // last register, heartbeat or work request
+	Alive       bool
+	Failures    []time.Time // when tasks failed on the worker, within the last blacklistWindow
+	Blacklisted bool        // the worker failed too many tasks and is given no work
+	Draining    bool        // the worker is leaving, it gets no new work and exits once nothing it holds is needed
+	Shared      bool        // the worker can read the master's job directory in place
+	Inputs      []string    // map inputs the worker holds, as of its last heartbeat
 }
 
 // Node (FingerTable, Successor, Predecessor, Bucket)
 type Master struct {
-	MapTasks    []MapTask
-	ReduceTasks []ReduceTask
-	Mappers     []string
-	MapProg     []int
-	Reducers    []string
-	ReduceProg  []int
-	Shutdown    bool
+	Jobs      []*Job    // running jobs, in the order they were submitted
+	Queue     []JobSpec // submitted jobs waiting for the master driver to start them
+	Cancelled []notice  // cancelled jobs
+	Finished  []notice  // jobs that are over, their files on the workers are no longer needed
+	Root      string    // directory holding the job directories
+	Workers   map[string]*WorkerInfo
+	Changed   chan struct{} // closed and replaced whenever the state changes, for long polls
+	Shutdown  bool
+}
+
+// notice (Job, Added)
+// tells workers about a job, until every live worker has heard of it
+type notice struct {
+	Job   string
+	Added time.Time
+}
+
+// jobNames returns the jobs of notices, in a new slice a reply can hold on to after the actor moves on
+func jobNames(notices []notice) []string {
+	names := make([]string, 0, len(notices))
+	for _, n := range notices {
+		names = append(names, n.Job)
+	}
+	return names
+}
+
+// without returns notices without the one about job, leaving the slice replies may still hold as it is
+func without(notices []notice, job string) []notice {
+	var kept []notice
+	for _, n := range notices {
+		if n.Job != job {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// pruneNotices drops the notices every live worker has been told about since they were added.
+// A worker that was dead meanwhile gets its attempts of the jobs revoked once it is back.
+func (f *Master) pruneNotices(notices []notice) []notice {
+	now := time.Now()
+	var kept []notice
+	for _, n := range notices {
+		heard := now.Sub(n.Added) >= heartbeatTimeout
+		for _, w := range f.Workers {
+			if w.Alive && !w.LastSeen.After(n.Added.Add(heartbeatInterval)) {
+				heard = false
+			}
+		}
+		if !heard {
+			kept = append(kept, n)
+		}
+	}
+	return kept
 }
 
 type handler func(*Master)
@@ -53,111 +214,770 @@ func (s Server) Ping(ip string, reply *Response) error {
 	return nil
 }
 
-// Ping (key, value, reply)
-func (s Server) GetWork(ip string, reply *Response) error {
+// Register (reg, reply)
+func (s Server) Register(reg Registration, reply *Response) error {
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		// check to see if shutting down
-		if f.Shutdown {
-			reply.WorkType = 0
-			reply.Shutdown = true
-			finished <- struct{}{}
+		if _, known := f.Workers[reg.Address]; known {
+			// a worker registers once when it starts, so this is a new process that has none of the old one's files
+			fmt.Printf("Worker '%s' has restarted\n", reg.Address)
+			f.forget(reg.Address)
+		}
+		f.seen(reg.Address)
+		f.Workers[reg.Address].Slots = reg.Slots
+		f.wake()
+		reply.Message = "Registered"
+		reply.Root = f.Root
+		reply.Shutdown = f.Shutdown
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Heartbeat (reg, reply)
+// carries the registration again, so a restarted master learns the worker's slots
+func (s Server) Heartbeat(reg Registration, reply *Response) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		f.seen(reg.Address)
+		w := f.Workers[reg.Address]
+		w.Slots = reg.Slots
+		if reg.Shared && !w.Shared {
+			fmt.Printf("Worker '%s' shares the master's filesystem, it reads map inputs in place\n", reg.Address)
+			f.wake()
+		}
+		w.Shared = reg.Shared
+		w.Inputs = reg.Inputs
+		reply.Revoked = f.renew(reg.Address, reg.Running)
+		reply.Cancelled = jobNames(f.Cancelled)
+		reply.Finished = jobNames(f.Finished)
+		reply.Shutdown = f.Shutdown
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Members (junk, reply)
+func (s Server) Members(_ Nothing, reply *[]WorkerInfo) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		for _, w := range f.Workers {
+			*reply = append(*reply, *w)
+		}
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// Drain (ip, junk)
+// takes the worker at ip out of service. It is given no new tasks, and is told it may exit once
+// its running tasks are done and the reducers and the master have fetched everything it serves.
+func (s Server) Drain(ip string, _ *Nothing) error {
+	var err error
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		w := f.Workers[ip]
+		if w == nil {
+			err = fmt.Errorf("no worker '%s'", ip)
+		} else if !w.Draining {
+			fmt.Printf("Draining worker '%s'\n", ip)
+			w.Draining = true
+			f.wake()
+		}
+		finished <- struct{}{}
+	}
+	<-finished
+	return err
+}
+
+// drained reports whether nothing on the worker at ip is needed any more: it runs no tasks,
+// holds no reduce output waiting to be merged, and no map output a reducer has yet to fetch
+func (f *Master) drained(ip string) bool {
+	if f.running(ip) > 0 {
+		return false
+	}
+	for _, job := range f.Jobs {
+		if job.Aborted {
+			continue
+		}
+		for i := range job.ReduceStatus {
+			// a reduce output may go once another worker holds a copy of it
+			task := &job.ReduceStatus[i]
+			if task.State == 2 && task.holds(ip) && len(task.Replicas) == 0 {
+				return false
+			}
+		}
+		if job.reducesDone() {
+			continue
+		}
+		for m := range job.MapStatus {
+			if job.MapStatus[m].State == 2 && job.MapStatus[m].Worker == ip {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// seen records that the worker at ip is alive, adding it to the membership table if needed
+func (f *Master) seen(ip string) {
+	if f.Workers == nil {
+		f.Workers = make(map[string]*WorkerInfo)
+	}
+	now := time.Now()
+	w, ok := f.Workers[ip]
+	if !ok {
+		fmt.Printf("Worker '%s' has joined\n", ip)
+		w = &WorkerInfo{Address: ip, Joined: now}
+		f.Workers[ip] = w
+	} else if !w.Alive {
+		fmt.Printf("Worker '%s' is back\n", ip)
+	}
+	w.LastSeen = now
+	w.Alive = true
+}
+
+// renew extends the leases of the attempts the worker at ip is still working on, and its time to copy
+// reduce outputs. Attempts it no longer reports, or that belong to a silent worker, run out as before.
+// The attempts it reports that are no longer its to run, because their lease ran out or they were
+// given up on, are returned as revoked so the worker stops them.
+func (f *Master) renew(ip string, running []Completion) (revoked []Completion) {
+	deadline := time.Now().Add(taskLease)
+	for _, attempt := range running {
+		job := f.job(attempt.Job)
+		if job == nil {
+			// the job is over, and the worker may have missed hearing about it
+			revoked = append(revoked, attempt)
+			continue
+		}
+		if attempt.WorkType == 3 {
+			if attempt.TaskID >= 0 && attempt.TaskID < len(job.ReduceStatus) {
+				if _, copying := job.ReduceStatus[attempt.TaskID].Copying[ip]; copying {
+					job.ReduceStatus[attempt.TaskID].Copying[ip] = deadline
+					continue
+				}
+			}
+			revoked = append(revoked, attempt)
+			continue
+		}
+		status := job.status(attempt.WorkType)
+		if attempt.TaskID < 0 || attempt.TaskID >= len(status) {
+			continue
+		}
+		if lease, ok := status[attempt.TaskID].Running[attempt.Attempt]; ok && lease.Worker == ip {
+			lease.Deadline = deadline
+			status[attempt.TaskID].Running[attempt.Attempt] = lease
+		} else {
+			revoked = append(revoked, attempt)
+		}
+	}
+	return revoked
+}
+
+// checkWorkers marks workers that have missed their heartbeats as dead and releases their tasks.
+// Completed map tasks on a dead worker are run again, since reducers can no longer fetch their output.
+// It reports whether any worker died.
+func (f *Master) checkWorkers() bool {
+	died := false
+	now := time.Now()
+	for ip, w := range f.Workers {
+		if !w.Alive || now.Sub(w.LastSeen) < heartbeatTimeout {
+			continue
+		}
+		fmt.Printf("Worker '%s' missed its heartbeats, marking it dead\n", ip)
+		w.Alive = false
+		died = true
+		f.forget(ip)
+	}
+	return died
+}
+
+// forget gives up on everything the worker at ip held. Its running attempts are abandoned,
+// its copies of reduce outputs are dropped, running the reduce task again if no copy is left,
+// and completed map tasks whose output reducers still need are run again.
+func (f *Master) forget(ip string) {
+	for _, job := range f.Jobs {
+		job.release(ip)
+		for i := range job.ReduceStatus {
+			task := &job.ReduceStatus[i]
+			delete(task.Copying, ip)
+			if task.State == 2 && task.holds(ip) {
+				fmt.Printf("A copy of the output of reduce job #%v of '%s' was on worker '%s', which is gone\n", i, job.Name, ip)
+				job.transition(Event{Kind: "lost", WorkType: 2, Task: i, Worker: ip})
+			}
+		}
+		if job.reducesDone() {
+			continue
+		}
+		for m := range job.MapStatus {
+			if job.MapStatus[m].State == 2 && job.MapStatus[m].Worker == ip {
+				fmt.Printf("Output of map job #%v of '%s' was on worker '%s', which is gone, rescheduling it\n", m, job.Name, ip)
+				job.transition(Event{Kind: "reset", WorkType: 1, Task: m})
+			}
+		}
+	}
+}
+
+// failed records a task failure on the worker at ip, and blacklists it once it has failed
+// blacklistFailures tasks within blacklistWindow, unless no other worker would be left to do the work
+func (f *Master) failed(ip string) {
+	w := f.Workers[ip]
+	if w == nil {
+		return
+	}
+	now := time.Now()
+	w.Failures = append(recentFailures(w.Failures, now), now)
+	if w.Blacklisted || len(w.Failures) < blacklistFailures {
+		return
+	}
+	for addr, other := range f.Workers {
+		if addr != ip && other.Alive && !other.Blacklisted && !other.Draining {
+			fmt.Printf("Worker '%s' failed %v tasks in %v, blacklisting it\n", ip, len(w.Failures), blacklistWindow)
+			w.Blacklisted = true
 			return
 		}
-		// check for map work
-		for i := range f.MapTasks {
-			if f.MapProg[i] == 0 { // there is work availaible
-				fmt.Printf("Worker '%s' has taken map job #%v\n", ip, i)
-				f.MapProg[i] = 1
-				f.Mappers[i] = ip
-				reply.Maptask = f.MapTasks[i]
+	}
+	fmt.Printf("Worker '%s' failed %v tasks in %v, but no other worker is left to blacklist it for\n", ip, len(w.Failures), blacklistWindow)
+}
+
+// checkBlacklist forgets failures older than blacklistWindow, and gives blacklisted workers
+// whose failures have aged out work again. It reports whether any worker came off the blacklist.
+func (f *Master) checkBlacklist() bool {
+	restored := false
+	now := time.Now()
+	for ip, w := range f.Workers {
+		w.Failures = recentFailures(w.Failures, now)
+		if w.Blacklisted && len(w.Failures) < blacklistFailures {
+			fmt.Printf("Worker '%s' has had no failures for a while, taking it off the blacklist\n", ip)
+			w.Blacklisted = false
+			restored = true
+		}
+	}
+	return restored
+}
+
+// recentFailures drops the failure times older than blacklistWindow
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range failures {
+		if now.Sub(t) < blacklistWindow {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// running returns the number of attempts in progress on the worker at ip
+func (f *Master) running(ip string) int {
+	count := 0
+	for _, job := range f.Jobs {
+		for _, status := range [][]TaskStatus{job.MapStatus, job.ReduceStatus} {
+			for i := range status {
+				for _, lease := range status[i].Running {
+					if lease.Worker == ip {
+						count++
+					}
+				}
+			}
+		}
+	}
+	return count
+}
+
+// local reports whether the worker at ip can read the input of map task i of job without downloading it,
+// because it shares the master's filesystem, or still holds the input it downloaded for an earlier attempt
+func (f *Master) local(job *Job, i int, ip string) bool {
+	w := f.Workers[ip]
+	if w == nil {
+		return false
+	}
+	if w.Shared {
+		return true
+	}
+	if !job.MapStatus[i].triedOn(ip) {
+		return false
+	}
+	input := jobFile(job.Name, mapInputFile(i))
+	for _, have := range w.Inputs {
+		if have == input {
+			return true
+		}
+	}
+	return false
+}
+
+// shuffling returns the number of reduce attempts on the worker at ip that are still waiting for map outputs
+func (f *Master) shuffling(ip string) int {
+	count := 0
+	for _, job := range f.Jobs {
+		if job.mapsDone() {
+			continue
+		}
+		for i := range job.ReduceStatus {
+			for _, lease := range job.ReduceStatus[i].Running {
+				if lease.Worker == ip {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// job returns the running job called name, or nil
+func (f *Master) job(name string) *Job {
+	for _, job := range f.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// GetWork (ip, reply)
+// blocks until there is a task for the worker, or longPollTimeout passes with WorkType 0
+func (s Server) GetWork(ip string, reply *Response) error {
+	timeout := time.After(longPollTimeout)
+	for {
+		var changed <-chan struct{}
+		finished := make(chan struct{})
+		s <- func(f *Master) {
+			f.seen(ip)
+			reply.Cancelled = jobNames(f.Cancelled)
+			reply.Finished = jobNames(f.Finished)
+			if w := f.Workers[ip]; w.Draining && f.drained(ip) {
+				fmt.Printf("Worker '%s' is drained, letting it go\n", ip)
+				reply.Drained = true
+			} else if !f.assign(ip, reply) {
+				changed = f.changed()
+			}
+			finished <- struct{}{}
+		}
+		<-finished
+		if changed == nil {
+			return nil
+		}
+		// wait for something to happen that might produce work
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// assign fills in reply with a task for the worker at ip, returning false if there is no work available
+func (f *Master) assign(ip string, reply *Response) bool {
+	// check to see if shutting down
+	if f.Shutdown {
+		reply.WorkType = 0
+		reply.Shutdown = true
+		return true
+	}
+	// keep the worker within the number of slots it advertised
+	slots := 1
+	if w := f.Workers[ip]; w != nil && w.Slots > 0 {
+		slots = w.Slots
+	}
+	if f.running(ip)-f.shuffling(ip) >= slots {
+		reply.WorkType = 0
+		return false
+	}
+	// a blacklisted worker gets nothing until it comes off the blacklist, a draining one gets nothing at all
+	if w := f.Workers[ip]; w != nil && (w.Blacklisted || w.Draining) {
+		reply.WorkType = 0
+		return false
+	}
+	// a task that failed on this worker is left for another live worker that has not failed it yet
+	avoidTask := func(t *TaskStatus) bool {
+		if !t.failedOn(ip) {
+			return false
+		}
+		for addr, w := range f.Workers {
+			if addr != ip && w.Alive && !w.Blacklisted && !w.Draining && !t.failedOn(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	// hand out idle tasks from the oldest job first, then backups of slow tasks
+	for _, backup := range []bool{false, true} {
+		for _, job := range f.Jobs {
+			if job.Aborted {
+				continue
+			}
+			// a worker that joined once the job was under way gets backups straight away, rather than sit idle.
+			// Workers that were there from the start, before any task completed, wait for speculateAfter as usual
+			after := speculateAfter
+			if w := f.Workers[ip]; w != nil && !job.Progressed.IsZero() && w.Joined.After(job.Progressed) {
+				after = 0
+			}
+			// check for map work, preferring tasks whose input the worker can read without downloading it
+			avoid := func(i int) bool { return avoidTask(&job.MapStatus[i]) }
+			remote := func(i int) bool { return avoid(i) || !f.local(job, i, ip) }
+			i := pickTask(job.MapStatus, ip, backup, after, remote)
+			if i < 0 {
+				i = pickTask(job.MapStatus, ip, backup, after, avoid)
+			}
+			if i >= 0 {
+				where := "remote"
+				if f.local(job, i, ip) {
+					where = "local"
+				}
+				if backup {
+					fmt.Printf("Worker '%s' has taken a backup of map job #%v of '%s', its input is %s\n", ip, i, job.Name, where)
+				} else {
+					fmt.Printf("Worker '%s' has taken map job #%v of '%s', its input is %s\n", ip, i, job.Name, where)
+				}
+				reply.Maptask = job.MapTasks[i]
+				if f.Workers[ip].Shared {
+					reply.Maptask.SourcePath = filepath.Join(f.Root, job.Name, mapSourceFile(i))
+				} else {
+					reply.Maptask.Cached = f.local(job, i, ip)
+				}
+				reply.TaskID = i
+				reply.Attempt = job.MapStatus[i].Attempts + 1
+				job.transition(Event{Kind: "start", WorkType: 1, Task: i, Attempt: reply.Attempt, Worker: ip})
 				reply.WorkType = 1
 				reply.Shutdown = false
-				finished <- struct{}{}
-				return
+				return true
 			}
-		}
-		// check for reduce work
-		for i := range f.ReduceProg {
-			if f.ReduceProg[i] == 0 { // there is work availaible
-				fmt.Printf("Worker '%s' has taken reduce job #%v\n", ip, i)
-				f.ReduceProg[i] = 1
-				f.Reducers[i] = ip
-				reply.Reducetask = f.ReduceTasks[i]
+			// check for reduce work. Reducers handed out while maps are still running only fetch
+			// map outputs, so they do not take a slot, but a worker shuffles at most slots of them at once
+			if !job.ReducePhase || (!job.mapsDone() && (backup || f.shuffling(ip) >= slots)) {
+				continue
+			}
+			avoid = func(i int) bool { return avoidTask(&job.ReduceStatus[i]) }
+			if i := pickTask(job.ReduceStatus, ip, backup, after, avoid); i >= 0 {
+				if backup {
+					fmt.Printf("Worker '%s' has taken a backup of reduce job #%v of '%s'\n", ip, i, job.Name)
+				} else {
+					fmt.Printf("Worker '%s' has taken reduce job #%v of '%s'\n", ip, i, job.Name)
+				}
+				reply.Reducetask = job.ReduceTasks[i]
+				// the reply is encoded after the actor moves on, while completing map tasks fill in the job's own slice
+				reply.Reducetask.SourceHosts = append([]string(nil), job.ReduceTasks[i].SourceHosts...)
+				reply.TaskID = i
+				reply.Attempt = job.ReduceStatus[i].Attempts + 1
+				job.transition(Event{Kind: "start", WorkType: 2, Task: i, Attempt: reply.Attempt, Worker: ip})
 				reply.WorkType = 2
 				reply.Shutdown = false
-				finished <- struct{}{}
-				return
+				return true
 			}
 		}
-		// there is no work available
-		reply.WorkType = 0
+	}
+	// with nothing else to do, keep copies of reduce outputs
+	if f.assignReplica(ip, reply) {
+		return true
+	}
+	// there is no work available
+	reply.WorkType = 0
+	return false
+}
+
+// assignReplica hands the worker at ip a reduce output to copy, if one has fewer than reduceReplicas copies.
+// Copies are not journaled, a copy that is not reported within taskLease is given up on.
+func (f *Master) assignReplica(ip string, reply *Response) bool {
+	now := time.Now()
+	for _, job := range f.Jobs {
+		if job.Aborted {
+			continue
+		}
+		for i := range job.ReduceStatus {
+			task := &job.ReduceStatus[i]
+			if task.State != 2 || task.holds(ip) {
+				continue
+			}
+			for w, deadline := range task.Copying {
+				if now.After(deadline) {
+					delete(task.Copying, w)
+				}
+			}
+			if len(task.Replicas)+len(task.Copying) >= reduceReplicas {
+				continue
+			}
+			if task.Copying == nil {
+				task.Copying = make(map[string]time.Time)
+			}
+			task.Copying[ip] = now.Add(taskLease)
+			fmt.Printf("Worker '%s' is copying the output of reduce job #%v of '%s' from '%s'\n", ip, i, job.Name, task.Worker)
+			reply.Replica = ReplicaTask{Job: job.Name, N: i, URL: makeURL(task.Worker, jobFile(job.Name, reduceOutputFile(i)))}
+			reply.TaskID = i
+			reply.WorkType = 3
+			reply.Shutdown = false
+			return true
+		}
+	}
+	return false
+}
+
+// changed returns a channel that is closed the next time the master's state changes
+func (f *Master) changed() <-chan struct{} {
+	if f.Changed == nil {
+		f.Changed = make(chan struct{})
+	}
+	return f.Changed
+}
+
+// wake releases everyone waiting on changed
+func (f *Master) wake() {
+	if f.Changed != nil {
+		close(f.Changed)
+		f.Changed = nil
+	}
+}
+
+// housekeeping returns the tasks of dead workers and expired leases to the pool,
+// and takes workers off the blacklist once their failures age out. It runs every second
+func (f *Master) housekeeping() {
+	changed := f.checkWorkers()
+	if f.checkBlacklist() {
+		changed = true
+	}
+	for _, job := range f.Jobs {
+		if job.expireLeases() {
+			changed = true
+		}
+	}
+	f.Cancelled = f.pruneNotices(f.Cancelled)
+	f.Finished = f.pruneNotices(f.Finished)
+	if changed {
+		f.wake()
+	}
+}
+
+// FinishedWork (report, reply)
+func (s Server) FinishedWork(report Completion, reply *Response) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		// ignore reports for unknown tasks, tasks already completed, and attempts that were superseded
+		job := f.job(report.Job)
+		if report.WorkType == 3 {
+			f.replicated(job, report)
+			finished <- struct{}{}
+			return
+		}
+		if job == nil || job.Aborted || (report.WorkType != 1 && report.WorkType != 2) || report.TaskID < 0 || report.TaskID >= len(job.status(report.WorkType)) {
+			fmt.Printf("Worker '%s' reported unknown task #%v of '%s', ignoring\n", report.Address, report.TaskID, report.Job)
+			finished <- struct{}{}
+			return
+		}
+		task := &job.status(report.WorkType)[report.TaskID]
+		if _, running := task.Running[report.Attempt]; task.State == 2 || !running {
+			fmt.Printf("Worker '%s' reported stale attempt %v of task #%v, ignoring\n", report.Address, report.Attempt, report.TaskID)
+			finished <- struct{}{}
+			return
+		}
+		job.transition(Event{Kind: "complete", WorkType: report.WorkType, Task: report.TaskID, Attempt: report.Attempt, Worker: report.Address})
+		f.wake()
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func (s Server) FinishedWork(ip string, reply *Response) error {
+// replicated records that the worker making report holds a copy of a reduce output
+func (f *Master) replicated(job *Job, report Completion) {
+	if job == nil || job.Aborted || report.TaskID < 0 || report.TaskID >= len(job.ReduceStatus) {
+		return
+	}
+	task := &job.ReduceStatus[report.TaskID]
+	delete(task.Copying, report.Address)
+	if task.State != 2 || task.holds(report.Address) {
+		return
+	}
+	fmt.Printf("Worker '%s' holds a copy of the output of reduce job #%v of '%s'\n", report.Address, report.TaskID, job.Name)
+	job.transition(Event{Kind: "replica", WorkType: 2, Task: report.TaskID, Worker: report.Address})
+}
+
+// ReduceOutputLost (report, junk)
+// the master driver could not fetch a reduce output from any worker holding a copy, the reduce task is run again
+func (s Server) ReduceOutputLost(report Completion, _ *Nothing) error {
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		for i := range f.MapTasks {
-			if f.Mappers[i] == ip && f.MapProg[i] != 2 {
-				f.MapProg[i] = 2
-				for j := 0; j < f.MapTasks[i].R; j++ {
-					f.ReduceTasks[j].SourceHosts = append(f.ReduceTasks[j].SourceHosts, makeURL(ip, mapOutputFile(i, j)))
-				}
+		job := f.job(report.Job)
+		if job != nil && report.TaskID >= 0 && report.TaskID < len(job.ReduceStatus) {
+			task := &job.ReduceStatus[report.TaskID]
+			for task.State == 2 {
+				job.transition(Event{Kind: "lost", WorkType: 2, Task: report.TaskID, Worker: task.Worker})
 			}
+			f.wake()
 		}
-		for i := range f.ReduceProg {
-			if f.Reducers[i] == ip {
-				f.ReduceProg[i] = 2
-			}
+		finished <- struct{}{}
+	}
+	<-finished
+	return nil
+}
+
+// FetchFailed (report, reply)
+// A reducer could not download a map output, so the map task is run again
+// and the reduce task is returned to the pool until the new output exists
+func (s Server) FetchFailed(report FetchFailure, reply *Response) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		job := f.job(report.Job)
+		if job == nil || job.Aborted || report.TaskID < 0 || report.TaskID >= len(job.ReduceStatus) || report.MapTask < 0 || report.MapTask >= len(job.MapStatus) {
+			fmt.Printf("Worker '%s' reported a fetch failure for an unknown task, ignoring\n", report.Address)
+			finished <- struct{}{}
+			return
+		}
+		m := report.MapTask
+		// only reschedule once, later reports for the same lost output are ignored
+		if job.MapStatus[m].State == 2 && job.ReduceTasks[report.TaskID].SourceHosts[m] == report.URL {
+			fmt.Printf("Output of map job #%v of '%s' on worker '%s' is unreachable, rescheduling it\n", m, job.Name, job.MapStatus[m].Worker)
+			job.transition(Event{Kind: "reset", WorkType: 1, Task: m})
+		}
+		if _, running := job.ReduceStatus[report.TaskID].Running[report.Attempt]; running {
+			job.transition(Event{Kind: "abandon", WorkType: 2, Task: report.TaskID, Attempt: report.Attempt})
 		}
+		f.wake()
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func (s Server) ExecuteMapTasks(Tasks []MapTask, junk *Nothing) error {
+// FailedWork (report, reply)
+// A task returned an error on the worker, the attempt is dropped and the task handed out again
+func (s Server) FailedWork(report Failure, reply *Response) error {
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		f.MapTasks = Tasks
-		for range f.MapTasks {
-			f.MapProg = append(f.MapProg, 0)
-			f.Mappers = append(f.Mappers, "")
+		job := f.job(report.Job)
+		if job == nil || job.Aborted || (report.WorkType != 1 && report.WorkType != 2) || report.TaskID < 0 || report.TaskID >= len(job.status(report.WorkType)) {
+			fmt.Printf("Worker '%s' reported a failure of unknown task #%v of '%s', ignoring\n", report.Address, report.TaskID, report.Job)
+			finished <- struct{}{}
+			return
+		}
+		task := &job.status(report.WorkType)[report.TaskID]
+		if _, running := task.Running[report.Attempt]; !running {
+			fmt.Printf("Worker '%s' reported failure of stale attempt %v of task #%v, ignoring\n", report.Address, report.Attempt, report.TaskID)
+			finished <- struct{}{}
+			return
 		}
-		var hosts []string
-		for i := 0; i < Tasks[0].R; i++ {
-			f.ReduceTasks = append(f.ReduceTasks, ReduceTask{M: Tasks[0].M, R: Tasks[0].R, N: i, SourceHosts: hosts})
-			f.Reducers = append(f.Reducers, "")
+		kind := "map"
+		if report.WorkType == 2 {
+			kind = "reduce"
 		}
+		fmt.Printf("Worker '%s' failed %s job #%v of '%s': %s\n", report.Address, kind, report.TaskID, job.Name, report.Error)
+		job.transition(Event{Kind: "fail", WorkType: report.WorkType, Task: report.TaskID, Attempt: report.Attempt, Worker: report.Address, Error: report.Error, Record: report.Record})
+		if report.Record != "" && report.WorkType == 1 && job.SkipBadRecords > 0 && task.Records[report.Record] == job.SkipBadRecords {
+			fmt.Printf("Record %q of map job #%v of '%s' keeps failing, it will be skipped\n", report.Record, report.TaskID, job.Name)
+		}
+		if report.Record == "" || job.SkipBadRecords == 0 {
+			// a bad record fails on every worker, only other failures count against this one
+			f.failed(report.Address)
+		}
+		if job.Failed != "" {
+			// the job is given up on, workers drop the rest of its tasks as if it was cancelled
+			fmt.Printf("Job '%s' failed: %s\n", job.Name, job.Failed)
+			f.Cancelled = append(f.Cancelled, notice{Job: job.Name, Added: time.Now()})
+		}
+		f.wake()
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func (s Server) GetMapTaskFinished(junk Nothing, response *LocalResponse) error {
+// MapOutputs (query, reply)
+// blocks until map outputs the shuffling reduce attempt does not have yet are known, or longPollTimeout passes.
+// Each call renews the attempt's lease, since a reducer may wait for the map phase longer than taskLease.
+func (s Server) MapOutputs(query ShuffleQuery, reply *ShuffleStatus) error {
+	timeout := time.After(longPollTimeout)
+	for {
+		var changed <-chan struct{}
+		finished := make(chan struct{})
+		s <- func(f *Master) {
+			f.seen(query.Address)
+			job := f.job(query.Job)
+			if job == nil || job.Aborted || query.WorkType != 2 || query.TaskID < 0 || query.TaskID >= len(job.ReduceStatus) {
+				reply.Stale = true
+				finished <- struct{}{}
+				return
+			}
+			task := &job.ReduceStatus[query.TaskID]
+			lease, running := task.Running[query.Attempt]
+			if !running {
+				reply.Stale = true
+				finished <- struct{}{}
+				return
+			}
+			lease.Deadline = time.Now().Add(taskLease)
+			task.Running[query.Attempt] = lease
+			reply.SourceHosts = append([]string(nil), job.ReduceTasks[query.TaskID].SourceHosts...)
+			if !newOutputs(reply.SourceHosts, query.Have) {
+				changed = f.changed()
+			}
+			finished <- struct{}{}
+		}
+		<-finished
+		if changed == nil {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// newOutputs reports whether hosts has the url of a map output that is missing from have
+func newOutputs(hosts []string, have []string) bool {
+	for m, url := range hosts {
+		if url != "" && (m >= len(have) || have[m] == "") {
+			return true
+		}
+	}
+	return false
+}
+
+// Submit (spec, junk)
+func (s Server) Submit(spec JobSpec, _ *Nothing) error {
+	if err := checkJobName(spec.Name); err != nil {
+		return err
+	}
+	if spec.M < 1 || spec.R < 1 {
+		return fmt.Errorf("job '%s' needs at least one map and one reduce task", spec.Name)
+	}
+	if err := checkKeyOrder(spec.KeyOrder); err != nil {
+		return err
+	}
+	var err error
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		done := true
-		for i := range f.MapTasks {
-			if f.MapProg[i] != 2 {
-				done = false
+		for _, queued := range f.Queue {
+			if queued.Name == spec.Name {
+				err = fmt.Errorf("job '%s' is already queued", spec.Name)
 			}
 		}
-		// if all MapProg values are "2"
-		if done {
-			response.TasksDone = true
-			response.AddressList = f.Mappers
-			// cleanup map tasks
-			f.MapTasks = f.MapTasks[:0]
-			f.MapProg = f.MapProg[:0]
-			f.Mappers = f.Mappers[:0]
-		} else {
-			response.TasksDone = false
+		if f.job(spec.Name) != nil {
+			err = fmt.Errorf("job '%s' is already running", spec.Name)
+		}
+		if err == nil {
+			// the name may belong to a cancelled job, workers must not drop the new one, nor delete its files
+			f.Cancelled = without(f.Cancelled, spec.Name)
+			f.Finished = without(f.Finished, spec.Name)
+			fmt.Printf("Queued job '%s': %s with %v map tasks and %v reduce tasks\n", spec.Name, spec.Source, spec.M, spec.R)
+			f.Queue = append(f.Queue, spec)
+		}
+		finished <- struct{}{}
+	}
+	<-finished
+	return err
+}
+
+// NextJob (junk, spec)
+// takes the oldest job off the queue, spec.Name is empty if nothing is queued
+func (s Server) NextJob(_ Nothing, spec *JobSpec) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		if len(f.Queue) > 0 {
+			*spec = f.Queue[0]
+			f.Queue = f.Queue[1:]
 		}
 		finished <- struct{}{}
 	}
@@ -165,41 +985,153 @@ func (s Server) GetMapTaskFinished(junk Nothing, response *LocalResponse) error
 	return nil
 }
 
-func (s Server) ExecuteReduceTasks(_ *Nothing, _ *Nothing) error {
+// startJob makes job's tasks available to workers, after applying every event already in j.
+// The tasks keep where they failed, but get maxTaskFailures more attempts.
+// New events are recorded in j, and the number of events replayed is returned.
+func (s Server) startJob(job *Job, j *journal) (int, error) {
+	events, err := j.events()
+	if err != nil {
+		return 0, err
+	}
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		for range f.ReduceTasks {
-			f.ReduceProg = append(f.ReduceProg, 0)
+		for _, e := range events {
+			job.apply(e)
+		}
+		// the failures before the restart do not count, so that a job that failed can be resumed
+		for _, status := range [][]TaskStatus{job.MapStatus, job.ReduceStatus} {
+			for i := range status {
+				status[i].Failures = 0
+			}
 		}
+		job.Journal = j
+		f.Jobs = append(f.Jobs, job)
+		f.wake()
+		finished <- struct{}{}
+	}
+	<-finished
+	return len(events), nil
+}
+
+// Phase (Job, WorkType)
+type Phase struct {
+	Job      string
+	WorkType int // 1 for the map phase, 2 for the reduce phase
+}
+
+// WaitForPhase (phase, response)
+// blocks until every task of the phase has completed or the job is cancelled or failed,
+// or longPollTimeout passes with neither TasksDone nor Aborted set
+func (s Server) WaitForPhase(phase Phase, response *LocalResponse) error {
+	timeout := time.After(longPollTimeout)
+	for {
+		var changed <-chan struct{}
+		finished := make(chan struct{})
+		s <- func(f *Master) {
+			f.phaseStatus(phase, response)
+			if !response.TasksDone && !response.Aborted {
+				changed = f.changed()
+			}
+			finished <- struct{}{}
+		}
+		<-finished
+		if changed == nil {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func (s Server) ExecuteReduceTasks(name string, _ *Nothing) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		if job := f.job(name); job != nil {
+			job.ReducePhase = true
+		}
+		f.wake()
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func (s Server) GetReduceTaskFinished(junk Nothing, response *LocalResponse) error {
+// phaseStatus reports whether every task of the phase has completed, and who completed them.
+// Map tasks are kept around after the phase, they may need to run again if their output is lost.
+func (f *Master) phaseStatus(phase Phase, response *LocalResponse) {
+	job := f.job(phase.Job)
+	response.TasksDone = false
+	response.Aborted = false
+	if job == nil {
+		return
+	}
+	if job.Aborted {
+		response.Aborted = true
+		response.Failed = job.Failed
+	} else if phase.WorkType == 1 && job.mapsDone() {
+		response.TasksDone = true
+		response.AddressList = workerList(job.MapStatus)
+	} else if phase.WorkType == 2 && job.reducesDone() {
+		response.TasksDone = true
+		response.AddressList = workerList(job.ReduceStatus)
+		response.Replicas = nil
+		for i := range job.ReduceStatus {
+			response.Replicas = append(response.Replicas, job.ReduceStatus[i].Replicas)
+		}
+	}
+}
+
+// CancelJob (name, junk)
+// drops a queued job, or aborts a running one. Workers hear about it in their next
+// work request or heartbeat, and the job's driver cleans up once it notices.
+func (s Server) CancelJob(name string, _ *Nothing) error {
+	var err error
 	finished := make(chan struct{})
 	s <- func(f *Master) {
-		done := true
-		for i := range f.ReduceTasks {
-			if f.ReduceProg[i] != 2 {
-				done = false
+		for i, queued := range f.Queue {
+			if queued.Name == name {
+				fmt.Printf("Removed job '%s' from the queue\n", name)
+				f.Queue = append(f.Queue[:i], f.Queue[i+1:]...)
+				finished <- struct{}{}
+				return
 			}
 		}
-		// if all MapProg values are "2"
-		if done {
-			response.TasksDone = true
-			response.AddressList = f.Reducers
-			// cleanup map tasks
-			f.ReduceTasks = f.ReduceTasks[:0]
-			f.ReduceProg = f.ReduceProg[:0]
-			f.Reducers = f.Reducers[:0]
-		} else {
-			response.TasksDone = false
+		job := f.job(name)
+		if job == nil {
+			err = fmt.Errorf("no job called '%s'", name)
+		} else if !job.Aborted {
+			fmt.Printf("Cancelling job '%s'\n", name)
+			job.Aborted = true
+			f.Cancelled = append(f.Cancelled, notice{Job: name, Added: time.Now()})
+			f.wake()
 		}
 		finished <- struct{}{}
 	}
 	<-finished
+	return err
+}
+
+// FinishJob (name, junk)
+// forgets a job once its output has been merged, or it was given up on. Workers hear about it
+// in their next work request or heartbeat, and delete the job's files.
+func (s Server) FinishJob(name string, _ *Nothing) error {
+	finished := make(chan struct{})
+	s <- func(f *Master) {
+		for i, job := range f.Jobs {
+			if job.Name == name {
+				f.Jobs = append(f.Jobs[:i], f.Jobs[i+1:]...)
+				f.Finished = append(f.Finished, notice{Job: name, Added: time.Now()})
+				break
+			}
+		}
+		// draining workers may have been waiting for the job's output to be merged
+		f.wake()
+		finished <- struct{}{}
+	}
+	<-finished
 	return nil
 }
 
@@ -207,13 +1139,15 @@ func (s Server) Shutdown(_ Nothing, _ *Nothing) error {
 	finished := make(chan struct{})
 	s <- func(f *Master) {
 		f.Shutdown = true
+		f.wake()
 		finished <- struct{}{}
 	}
 	<-finished
 	return nil
 }
 
-func startMActor() Server {
+// startMActor starts the master's actor and its housekeeping tick, stop ends the tick
+func startMActor() (Server, func()) {
 	ch := make(chan handler)
 	state := new(Master)
 	go func() {
@@ -221,34 +1155,78 @@ func startMActor() Server {
 			f(state)
 		}
 	}()
-	return ch
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ch <- (*Master).housekeeping
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, func() { close(done) }
 }
 
-func masterServer(address string, port int, tempdir string) Server {
-	actor := startMActor()
-	rpc.Register(actor)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", fmt.Sprintf(":%v", port))
-	if e != nil {
-		log.Fatal("listen error:", e)
+// masterServer starts the master's actor, and serves its rpc and the files in tempdir on port.
+// stop closes the listener again, so that several masters can come and go in one process, and removes the rootMarker.
+func masterServer(address string, port int, tempdir string) (actor Server, stop func(), err error) {
+	// workers that can read this file share our filesystem
+	if err := ioutil.WriteFile(filepath.Join(tempdir, rootMarker), []byte(address), 0664); err != nil {
+		return nil, nil, err
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen error: %v", err)
+	}
+	actor, stopActor := startMActor()
+	actor <- func(f *Master) {
+		f.Root = tempdir
 	}
-	http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
-	go http.Serve(l, nil)
+	server := rpc.NewServer()
+	server.Register(actor)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(l)
 
 	fmt.Printf("RPC and File Server Running on %v\n", address)
-	return actor
+	stop = func() {
+		httpServer.Close()
+		stopActor()
+		os.Remove(filepath.Join(tempdir, rootMarker))
+	}
+	return actor, stop, nil
 }
 
-func getLocalAddress(port int) string {
+// getLocalAddress returns the address of this host on port, as seen by the rest of the network
+func getLocalAddress(port int) (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("finding this host's address: %v", err)
 	}
 	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	return localAddr.IP.String() + ":" + fmt.Sprint(port)
+	return localAddr.IP.String() + ":" + fmt.Sprint(port), nil
+}
+
+// callRetry is callErr, retrying every second until masterRetryTimeout has passed
+func callRetry(address string, method string, request interface{}, response interface{}) error {
+	deadline := time.Now().Add(masterRetryTimeout)
+	for {
+		err := callErr(address, method, request, response)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		log.Printf("%s failed, retrying: %v\n", method, err)
+		time.Sleep(1 * time.Second)
+	}
 }
 
 func callErr(address string, method string, request interface{}, response interface{}) error {
@@ -0,0 +1,256 @@
+package mapreduce
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenewRevokesAttemptsTheWorkerNoLongerHolds(t *testing.T) {
+	job := newJob(JobSpec{Name: "job", M: 2, R: 1}, "master:1", nil)
+	job.apply(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	job.apply(Event{Kind: "start", WorkType: 1, Task: 1, Attempt: 1, Worker: "a"})
+	job.apply(Event{Kind: "abandon", WorkType: 1, Task: 1, Attempt: 1})
+	job.apply(Event{Kind: "start", WorkType: 1, Task: 1, Attempt: 2, Worker: "b"})
+	stale := time.Now().Add(time.Second)
+	lease := job.MapStatus[0].Running[1]
+	lease.Deadline = stale
+	job.MapStatus[0].Running[1] = lease
+	f := &Master{Jobs: []*Job{job}}
+
+	running := []Completion{
+		{Address: "a", Job: "job", WorkType: 1, TaskID: 0, Attempt: 1},
+		{Address: "a", Job: "job", WorkType: 1, TaskID: 1, Attempt: 1},
+		{Address: "a", Job: "job", WorkType: 3, TaskID: 0},
+		{Address: "a", Job: "over", WorkType: 2, TaskID: 0, Attempt: 1},
+	}
+	revoked := f.renew("a", running)
+
+	if !job.MapStatus[0].Running[1].Deadline.After(stale) {
+		t.Errorf("the lease of map task #0 was not renewed")
+	}
+	if want := running[1:]; !reflect.DeepEqual(revoked, want) {
+		t.Errorf("revoked %+v, want %+v", revoked, want)
+	}
+	if job.MapStatus[1].Running[2].Worker != "b" {
+		t.Errorf("the attempt on b was touched: %+v", job.MapStatus[1].Running)
+	}
+}
+
+func TestOnlyWorkersJoiningAJobUnderWayGetBackupsStraightAway(t *testing.T) {
+	job := newJob(JobSpec{Name: "job", M: 2, R: 1}, "master:1", nil)
+	job.transition(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	job.transition(Event{Kind: "start", WorkType: 1, Task: 1, Attempt: 1, Worker: "a"})
+	start := time.Now().Add(-time.Minute)
+	f := &Master{Jobs: []*Job{job}, Workers: map[string]*WorkerInfo{
+		"a": {Address: "a", Slots: 2, Joined: start, Alive: true},
+		"b": {Address: "b", Slots: 2, Joined: start, Alive: true},
+	}}
+
+	// before any task completed, nobody is a late joiner
+	var reply Response
+	if f.assign("b", &reply) {
+		t.Fatalf("b got %+v before the job made progress", reply)
+	}
+	job.transition(Event{Kind: "complete", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	f.Workers["c"] = &WorkerInfo{Address: "c", Slots: 2, Joined: time.Now().Add(time.Second), Alive: true}
+
+	// half the maps are done, short of speculateAfter
+	reply = Response{}
+	if f.assign("b", &reply) {
+		t.Errorf("b, there from the start, got %+v", reply)
+	}
+	reply = Response{}
+	if !f.assign("c", &reply) || reply.WorkType != 1 || reply.TaskID != 1 || reply.Attempt != 2 {
+		t.Errorf("c, which joined later, got %+v, want a backup of map task #1", reply)
+	}
+}
+
+func TestNoticesArePrunedOnceEveryLiveWorkerHeardOfThem(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	f := &Master{Workers: map[string]*WorkerInfo{
+		"a":    {Address: "a", Alive: true, LastSeen: now},
+		"b":    {Address: "b", Alive: true, LastSeen: now},
+		"dead": {Address: "dead", LastSeen: old.Add(-time.Hour)},
+	}}
+	notices := []notice{{Job: "old", Added: old}, {Job: "new", Added: now}}
+	if kept := f.pruneNotices(notices); len(kept) != 1 || kept[0].Job != "new" {
+		t.Errorf("kept %+v, want only the new notice", kept)
+	}
+
+	f.Workers["b"].LastSeen = old.Add(heartbeatInterval)
+	if kept := f.pruneNotices(notices); len(kept) != 2 {
+		t.Errorf("kept %+v, want both while b has not heard of them", kept)
+	}
+}
+
+func TestBlacklistedWorkerGetsNoWorkUntilItsFailuresAgeOut(t *testing.T) {
+	job := newJob(JobSpec{Name: "job", M: 2, R: 1}, "master:1", nil)
+	f := &Master{Jobs: []*Job{job}, Workers: map[string]*WorkerInfo{
+		"a": {Address: "a", Slots: 2, Alive: true},
+		"b": {Address: "b", Slots: 2, Alive: true},
+	}}
+	for i := 0; i < blacklistFailures; i++ {
+		f.failed("a")
+	}
+	if !f.Workers["a"].Blacklisted {
+		t.Fatalf("a failed %v tasks and was not blacklisted", blacklistFailures)
+	}
+	var reply Response
+	if f.assign("a", &reply) {
+		t.Errorf("blacklisted a got %+v", reply)
+	}
+
+	// b is the last worker standing, so it keeps working however often it fails
+	for i := 0; i < blacklistFailures; i++ {
+		f.failed("b")
+	}
+	if f.Workers["b"].Blacklisted {
+		t.Errorf("b was blacklisted with no other worker left")
+	}
+
+	// once its failures age out, a gets work again
+	for i := range f.Workers["a"].Failures {
+		f.Workers["a"].Failures[i] = time.Now().Add(-blacklistWindow)
+	}
+	if !f.checkBlacklist() || f.Workers["a"].Blacklisted {
+		t.Fatalf("a stayed on the blacklist after its failures aged out")
+	}
+	reply = Response{}
+	if !f.assign("a", &reply) || reply.WorkType != 1 {
+		t.Errorf("a got %+v once off the blacklist, want a map task", reply)
+	}
+}
+
+func TestDrainedWorkerIsLetGoOnceNothingItHoldsIsNeeded(t *testing.T) {
+	job := newJob(JobSpec{Name: "job", M: 1, R: 1}, "master:1", nil)
+	job.transition(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	job.transition(Event{Kind: "complete", WorkType: 1, Task: 0, Attempt: 1, Worker: "a"})
+	f := &Master{Jobs: []*Job{job}, Workers: map[string]*WorkerInfo{
+		"a": {Address: "a", Slots: 2, Alive: true, Draining: true},
+		"b": {Address: "b", Slots: 2, Alive: true},
+	}}
+	var reply Response
+	if f.assign("a", &reply) {
+		t.Errorf("draining a got %+v", reply)
+	}
+	if f.drained("a") {
+		t.Fatalf("a was drained while the reducer has yet to fetch its map output")
+	}
+	job.ReducePhase = true
+	job.transition(Event{Kind: "start", WorkType: 2, Task: 0, Attempt: 1, Worker: "b"})
+	job.transition(Event{Kind: "complete", WorkType: 2, Task: 0, Attempt: 1, Worker: "b"})
+	if !f.drained("a") {
+		t.Errorf("a was not drained once the reduce phase was done")
+	}
+
+	// through rpc, a worker that holds nothing is let go straight away
+	actor, stop := startMActor()
+	defer stop()
+	if err := actor.Drain("a", nil); err == nil {
+		t.Errorf("draining an unknown worker did not fail")
+	}
+	if err := actor.Heartbeat(Registration{Address: "a", Slots: 1}, &Response{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := actor.Drain("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	reply = Response{}
+	if err := actor.GetWork("a", &reply); err != nil || !reply.Drained {
+		t.Errorf("GetWork = %+v, %v, want a let go", reply, err)
+	}
+}
+
+func TestCancelJobDropsQueuedJobsAndAbortsRunningOnes(t *testing.T) {
+	actor, stop := startMActor()
+	defer stop()
+	running := newJob(JobSpec{Name: "running", M: 1, R: 1}, "master:1", nil)
+	finished := make(chan struct{})
+	actor <- func(f *Master) {
+		f.Jobs = []*Job{running}
+		f.Queue = []JobSpec{{Name: "first"}, {Name: "queued"}, {Name: "last"}}
+		finished <- struct{}{}
+	}
+	<-finished
+
+	for _, name := range []string{"queued", "running"} {
+		if err := actor.CancelJob(name, nil); err != nil {
+			t.Fatalf("cancelling %s: %v", name, err)
+		}
+	}
+	if err := actor.CancelJob("unknown", nil); err == nil {
+		t.Errorf("cancelling an unknown job did not fail")
+	}
+
+	var queue []JobSpec
+	var aborted bool
+	var cancelled []string
+	actor <- func(f *Master) {
+		queue, aborted, cancelled = f.Queue, running.Aborted, jobNames(f.Cancelled)
+		finished <- struct{}{}
+	}
+	<-finished
+	if len(queue) != 2 || queue[0].Name != "first" || queue[1].Name != "last" {
+		t.Errorf("queue holds %+v, want first and last", queue)
+	}
+	if !aborted || !reflect.DeepEqual(cancelled, []string{"running"}) {
+		t.Errorf("running job aborted %v, workers told to cancel %q", aborted, cancelled)
+	}
+}
+
+func TestFetchFailedReschedulesTheLostMapOutputOnce(t *testing.T) {
+	actor, stop := startMActor()
+	defer stop()
+	job := newJob(JobSpec{Name: "job", M: 2, R: 1}, "master:1", nil)
+	for m := 0; m < 2; m++ {
+		job.transition(Event{Kind: "start", WorkType: 1, Task: m, Attempt: 1, Worker: "a"})
+		job.transition(Event{Kind: "complete", WorkType: 1, Task: m, Attempt: 1, Worker: "a"})
+	}
+	job.transition(Event{Kind: "start", WorkType: 2, Task: 0, Attempt: 1, Worker: "b"})
+	finished := make(chan struct{})
+	actor <- func(f *Master) {
+		f.Jobs = []*Job{job}
+		finished <- struct{}{}
+	}
+	<-finished
+
+	lost := makeURL("a", jobFile("job", mapOutputFile(0, 0)))
+	report := FetchFailure{Completion: Completion{Address: "b", Job: "job", WorkType: 2, TaskID: 0, Attempt: 1}, MapTask: 0, URL: lost}
+	if err := actor.FetchFailed(report, &Response{}); err != nil {
+		t.Fatal(err)
+	}
+	var maps []TaskStatus
+	var reduce TaskStatus
+	actor <- func(f *Master) {
+		maps, reduce = append([]TaskStatus(nil), job.MapStatus...), job.ReduceStatus[0]
+		finished <- struct{}{}
+	}
+	<-finished
+	if maps[0].State != 0 || maps[1].State != 2 {
+		t.Errorf("map tasks %+v, want only #0 to run again", maps)
+	}
+	if len(reduce.Running) != 0 {
+		t.Errorf("reduce task #0 still runs %+v, want the attempt that could not fetch dropped", reduce.Running)
+	}
+
+	// the map task ran again elsewhere, a late report about the old output changes nothing
+	actor <- func(f *Master) {
+		job.transition(Event{Kind: "start", WorkType: 1, Task: 0, Attempt: 2, Worker: "c"})
+		job.transition(Event{Kind: "complete", WorkType: 1, Task: 0, Attempt: 2, Worker: "c"})
+		finished <- struct{}{}
+	}
+	<-finished
+	if err := actor.FetchFailed(report, &Response{}); err != nil {
+		t.Fatal(err)
+	}
+	actor <- func(f *Master) {
+		maps = append([]TaskStatus(nil), job.MapStatus...)
+		finished <- struct{}{}
+	}
+	<-finished
+	if maps[0].State != 2 || maps[0].Worker != "c" {
+		t.Errorf("map task #0 = %+v, want its new output on c kept", maps[0])
+	}
+}
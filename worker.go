@@ -1,25 +1,45 @@
 package mapreduce
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"hash/fnv"
-	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type MapTask struct {
-	M, R       int    // total number of map and reduce tasks
-	N          int    // map task number, 0-based
-	SourceHost string // address of host with map input file
+	Job         string   // name of the job, and its directory on every node
+	M, R        int      // total number of map and reduce tasks
+	N           int      // map task number, 0-based
+	SourceHost  string   // address of host with map input file
+	SkipMode    bool     // recover from a failing Map and report the record, so the master can have it skipped
+	Skip        []string // keys of input records to skip, Map kept failing on them
+	SourcePath  string   // path of the map input on the master, set for workers sharing its filesystem
+	Cached      bool     // the worker still holds the input it downloaded for an earlier attempt
+	SplitPoints []string // in total order mode, the sorted keys that divide the key space between reduce tasks
+	KeyOrder    string   // named order of keys, empty for sqlite's text order
 }
 
 type ReduceTask struct {
+	Job         string   // name of the job, and its directory on every node
 	M, R        int      // total number of map and reduce tasks
 	N           int      // reduce task number, 0-based
-	SourceHosts []string // addresses of map workers
+	SourceHosts []string // url of each map task's output, indexed by map task number, empty until the map task completes
+	KeyOrder    string   // named order of keys, empty for sqlite's text order
+	shuffled    bool     // the map outputs have been fetched by Shuffle
+}
+
+// ReplicaTask (Job, N, URL)
+type ReplicaTask struct {
+	Job string // name of the job, and its directory on every node
+	N   int    // reduce task whose output is copied
+	URL string // url of the output on a worker that holds it
 }
 
 type Pair struct {
@@ -32,14 +52,108 @@ type Interface interface {
 	Reduce(key string, values <-chan string, output chan<- Pair) error
 }
 
+// ContextInterface can be implemented by a client alongside Interface, MapContext and ReduceContext are
+// then called instead of Map and Reduce. ctx is cancelled when the task's job is cancelled or the master
+// revokes the attempt, for example after it lost touch with the worker, and carries the task's TaskInfo.
+type ContextInterface interface {
+	MapContext(ctx context.Context, key, value string, output chan<- Pair) error
+	ReduceContext(ctx context.Context, key string, values <-chan string, output chan<- Pair) error
+}
+
+// Combiner can be implemented by a client to merge the values a map task emitted for each key
+// before they are shuffled, word count for example can combine with its Reduce.
+// Combine is called with the values of one key and should only output pairs with that key,
+// its output is fed to Reduce along with that of the other map tasks.
+type Combiner interface {
+	Combine(key string, values <-chan string, output chan<- Pair) error
+}
+
+// Partitioner can be implemented by a client to choose the reduce task, 0 to r-1, a key goes to.
+// Keys are spread with HashPartition otherwise.
+type Partitioner interface {
+	Partition(key string, r int) int
+}
+
+// HashPartition is the default partitioning of keys, by their FNV hash
+func HashPartition(key string, r int) int {
+	hash := fnv.New32() // from the stdlib package hash/fnv
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(r))
+}
+
+// Grouper can be implemented by a client whose Map outputs composite keys, made of a group key and a sort key.
+// Reduce is then called once for each group key, with the values of every key in the group in the order of
+// their keys, so a group's values can be ordered by a timestamp for example. Keys are partitioned by their group key.
+type Grouper interface {
+	Group(key string) string
+}
+
+// ValueSorter can be implemented by a client to choose the order Reduce gets the values of a key in,
+// LessValue reports whether value a goes before value b. Values are in sqlite's text order otherwise.
+type ValueSorter interface {
+	LessValue(a, b string) bool
+}
+
+// KeySorter can be implemented by a client to choose the order of keys, LessKey reports whether key a goes
+// before key b. It is used for Reduce's input, the job's output and the ranges of total order mode, in place of
+// the job's KeyOrder. The master needs the client as well to sort the job's output.
+type KeySorter interface {
+	LessKey(a, b string) bool
+}
+
+// groupKey returns the key pairs are grouped and partitioned by, the key itself unless client is a Grouper
+func groupKey(client Interface) func(key string) string {
+	if g, ok := client.(Grouper); ok {
+		return g.Group
+	}
+	return func(key string) string { return key }
+}
+
+// reduceFunc is the signature of Reduce, and of Combine
+type reduceFunc func(key string, values <-chan string, output chan<- Pair) error
+
+// TaskInfo (Job, WorkType, N, M, R)
+type TaskInfo struct {
+	Job      string // name of the job
+	WorkType int    // 1 for a map task, 2 for a reduce task
+	N        int    // task number, 0-based, or -1 while the master samples Map's keys in total order mode
+	M, R     int    // total number of map and reduce tasks
+}
+
+type taskInfoKey struct{}
+
+// TaskInfoFrom returns the TaskInfo carried by the context passed to a ContextInterface
+func TaskInfoFrom(ctx context.Context) (TaskInfo, bool) {
+	info, ok := ctx.Value(taskInfoKey{}).(TaskInfo)
+	return info, ok
+}
+
+// taskContext is the context a task's client calls get, it carries the task's TaskInfo
+func taskContext(ctx context.Context, info TaskInfo) context.Context {
+	return context.WithValue(ctx, taskInfoKey{}, info)
+}
+
 func mapSourceFile(m int) string       { return fmt.Sprintf("map_%d_source.db", m) }
 func mapInputFile(m int) string        { return fmt.Sprintf("map_%d_input.db", m) }
 func mapOutputFile(m, r int) string    { return fmt.Sprintf("map_%d_output_%d.db", m, r) }
+func mapCombineFile(m, r int) string   { return fmt.Sprintf("map_%d_combine_%d.db", m, r) }
 func reduceInputFile(r int) string     { return fmt.Sprintf("reduce_%d_input.db", r) }
 func reduceOutputFile(r int) string    { return fmt.Sprintf("reduce_%d_output.db", r) }
 func reducePartialFile(r int) string   { return fmt.Sprintf("reduce_%d_partial.db", r) }
 func reduceTempFile(r int) string      { return fmt.Sprintf("reduce_%d_temp.db", r) }
 func makeURL(host, file string) string { return fmt.Sprintf("http://%s/data/%s", host, file) }
+func jobFile(job, file string) string  { return path.Join(job, file) }
+
+// RecordError (Key, Err)
+// In skip mode a map task that fails on an input record returns a RecordError naming the record
+type RecordError struct {
+	Key string // key of the input record
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v (record %q)", e.Err, e.Key)
+}
 
 // create R output files !
 
@@ -47,195 +161,451 @@ func makeURL(host, file string) string { return fmt.Sprintf("http://%s/data/%s",
 // This helper will wait for channel items to come out of the client.Map channel and will add them to the correct database.
 // before starting the helper, create another channel that will tell the helper when client.Map is finished
 
-func (task *MapTask) Process(tempdir string, client Interface) error {
-	fmt.Printf("Processing MapTask #%d\n", task.N)
-
-	// download Source file as the Input File
-	download(makeURL(task.SourceHost, mapSourceFile(task.N)), filepath.Join(tempdir, mapInputFile(task.N)))
+// Process runs the map task, stopping early with ctx.Err() if ctx is cancelled.
+// Any other failure, including an error from client.Map, is returned for the worker to report to the master.
+func (task *MapTask) Process(ctx context.Context, tempdir string, client Interface) error {
+	fmt.Printf("Processing MapTask #%d of '%s'\n", task.N, task.Job)
+	ctx = taskContext(ctx, TaskInfo{Job: task.Job, WorkType: 1, N: task.N, M: task.M, R: task.R})
+	tempdir = filepath.Join(tempdir, task.Job)
+	os.MkdirAll(tempdir, 0775)
+
+	// download Source file as the Input File, unless it can be read where it is or is already here
+	input := filepath.Join(tempdir, mapInputFile(task.N))
+	if task.SourcePath != "" {
+		input = task.SourcePath
+	} else if _, err := os.Stat(input); !task.Cached || err != nil {
+		url := makeURL(task.SourceHost, jobFile(task.Job, mapSourceFile(task.N)))
+		if err := download(url, input); err != nil {
+			return fmt.Errorf("map task #%d: downloading input: %v", task.N, err)
+		}
+	}
 
 	// Split the Input file into many Output files
+	// with a combiner they are scratch files, combined into the Output files once every record is mapped
+	combiner, combining := client.(Combiner)
 	var dbs []*sql.DB
+	defer func() {
+		for i := 0; i < len(dbs); i++ {
+			dbs[i].Close()
+			if combining {
+				os.Remove(filepath.Join(tempdir, mapCombineFile(task.N, i)))
+			}
+		}
+	}()
 	for i := 0; i < task.R; i++ {
 		dbfile := filepath.Join(tempdir, mapOutputFile(task.N, i))
+		if combining {
+			dbfile = filepath.Join(tempdir, mapCombineFile(task.N, i))
+		}
 		tdb, err := createDatabase(dbfile)
 		if err != nil {
-			log.Fatalf("Error processing Maptask: %v\n", err)
-			return err
+			return fmt.Errorf("map task #%d: %v", task.N, err)
 		}
 		dbs = append(dbs, tdb)
 	}
 
 	// Open the source file
-	sourceDb, err := openDatabase(filepath.Join(tempdir, mapInputFile(task.N)))
+	sourceDb, err := openDatabase(input)
 	if err != nil {
-		log.Fatalf("Error processing Maptask: %v\n", err)
-		return err
+		return fmt.Errorf("map task #%d: %v", task.N, err)
 	}
+	defer sourceDb.Close()
 	// pull pairs from source file
 	rows, err := sourceDb.Query("select key, value from pairs")
 	if err != nil {
-		log.Fatalf("Error processing Maptask: %v\n", err)
-		return err
+		return fmt.Errorf("map task #%d: %v", task.N, err)
+	}
+	defer rows.Close()
+
+	// the reduce task each pair goes to, by range in total order mode, pairs of a group go together
+	group := groupKey(client)
+	partition := HashPartition
+	if len(task.SplitPoints) > 0 {
+		partition = rangePartition(task.SplitPoints, keyLess(client, task.KeyOrder))
+	} else if p, ok := client.(Partitioner); ok {
+		partition = p.Partition
+	}
+
+	// records the master has told us to skip
+	skip := make(map[string]bool)
+	for _, key := range task.Skip {
+		skip[key] = true
 	}
 
 	// loop over every pair
 	for rows.Next() {
+		// stop early if the job was cancelled
+		if ctx.Err() != nil {
+			break
+		}
 		// put the pair into a Pair object
 		var key string
 		var value string
 		err = rows.Scan(&key, &value)
 		if err != nil {
-			log.Fatalf("Error processing Maptask: %v\n", err)
-			return err
+			return fmt.Errorf("map task #%d: %v", task.N, err)
+		}
+		if skip[key] {
+			fmt.Printf("Skipping bad record %q of MapTask #%d\n", key, task.N)
+			continue
 		}
 
 		// pass them into a client.Map function
 		// we call a goroutine to handle the channel while the main routine handles the client.Map function
 		pairChan := make(chan Pair, 100)
-		if err != nil {
-			log.Fatalf("Error processing Maptask: %v\n", err)
-			return err
-		}
 		// goroutine to get the pair from the channel and insert it into the correct output file
-		finished := make(chan struct{})
+		// it keeps draining the channel after a failed insert so client.Map is never left blocked
+		finished := make(chan error, 1)
 		go func() {
+			var insertErr error
 			for pair := range pairChan {
-				hash := fnv.New32() // from the stdlib package hash/fnv
-				hash.Write([]byte(pair.Key))
-				index := int(hash.Sum32() % uint32(task.R)) // index is the output file this pair should go in
-				_, err := dbs[index].Exec("insert into pairs (key, value) values (?,?)", pair.Key, pair.Value)
-				if err != nil {
-					log.Fatalf("Error processing Maptask: %v\n", err)
+				if insertErr != nil {
+					continue
 				}
+				index := partition(group(pair.Key), task.R) // index is the output file this pair should go in
+				if index < 0 || index >= task.R {
+					insertErr = fmt.Errorf("Partition(%q) returned %d, not a reduce task", group(pair.Key), index)
+					continue
+				}
+				_, insertErr = dbs[index].Exec("insert into pairs (key, value) values (?,?)", pair.Key, pair.Value)
 			}
-			// push a value into the finished channel to tell the main loop it can continue
-			finished <- struct{}{}
+			// push the result into the finished channel to tell the main loop it can continue
+			finished <- insertErr
 		}()
 		// call client.Map on the key value, the goroutine above will process the result and add it to the correct output
 		// Map(key, value string, output chan<- Pair) error
-		err = client.Map(key, value, pairChan)
-		if err != nil {
-			log.Fatalf("Error processing Maptask: %v\n", err)
-			return err
-		}
+		panicked, mapErr := callMap(ctx, client, key, value, pairChan, task.SkipMode)
 		// pause until the worker has finished inserting keys. aka wait for a value from finished
-		<-finished
-		close(finished)
+		insertErr := <-finished
+		if panicked {
+			return &RecordError{Key: key, Err: fmt.Errorf("map task #%d: Map: %v", task.N, mapErr)}
+		}
+		if mapErr != nil && task.SkipMode {
+			return &RecordError{Key: key, Err: fmt.Errorf("map task #%d: Map: %v", task.N, mapErr)}
+		}
+		if mapErr != nil {
+			return fmt.Errorf("map task #%d: Map(%q): %v", task.N, key, mapErr)
+		}
+		if insertErr != nil {
+			return fmt.Errorf("map task #%d: %v", task.N, insertErr)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("map task #%d: %v", task.N, err)
+	}
+
+	if combining && ctx.Err() == nil {
+		for i := range dbs {
+			if err := combine(ctx, dbs[i], filepath.Join(tempdir, mapOutputFile(task.N, i)), combiner); err != nil {
+				return fmt.Errorf("map task #%d: %v", task.N, err)
+			}
+		}
 	}
 
-	//close open databases
-	for i := 0; i < len(dbs); i++ {
-		dbs[i].Close()
+	return ctx.Err()
+}
+
+// rangePartition partitions keys in total order mode, ordered by less: keys below the first split point go
+// to reduce task 0, keys from the first split point up to the second go to reduce task 1, and so on
+func rangePartition(points []string, less func(a, b string) bool) func(key string, r int) int {
+	// the master sorts the points, but may not know the client's order
+	points = append([]string(nil), points...)
+	sortKeys(points, less)
+	if less == nil {
+		less = func(a, b string) bool { return a < b }
+	}
+	return func(key string, r int) int {
+		return sort.Search(len(points), func(i int) bool { return less(key, points[i]) })
 	}
-	sourceDb.Close()
+}
 
+// combine runs the combiner over the map output in input, one key at a time, and writes the result to output
+func combine(ctx context.Context, input *sql.DB, output string, combiner Combiner) error {
+	outputDb, err := createDatabase(output)
+	if err != nil {
+		return err
+	}
+	defer outputDb.Close()
+
+	rows, err := input.Query("select key, value from pairs order by key")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return reduceRows(ctx, rows, outputDb, nil, "Combine", combiner.Combine)
+}
+
+// callMap runs client.Map, or MapContext with ctx, on a single record. With recovering set a panic in Map
+// is returned as an error instead of crashing the worker, and panicked is set. output is closed either way,
+// so whatever reads it finishes.
+func callMap(ctx context.Context, client Interface, key, value string, output chan<- Pair, recovering bool) (panicked bool, err error) {
+	if recovering {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+				err = fmt.Errorf("panic: %v", r)
+				// Map may have closed output before it panicked, closing it again panics too
+				defer func() { recover() }()
+				close(output)
+			}
+		}()
+	}
+	if c, ok := client.(ContextInterface); ok {
+		return false, c.MapContext(ctx, key, value, output)
+	}
+	return false, client.Map(key, value, output)
+}
+
+// ready reports whether the output of every map task is known, so the reduce can start straight away
+func (task *ReduceTask) ready() bool {
+	for _, url := range task.SourceHosts {
+		if url == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Shuffle fetches the map outputs of a reduce task handed out before the map phase is over,
+// each one as soon as its map task completes. outputs blocks until the master knows of outputs
+// missing from have, and returns the url of every map task's output known so far.
+// A task that is already ready is left for Process to fetch.
+func (task *ReduceTask) Shuffle(ctx context.Context, tempdir string, outputs func(have []string) ([]string, error)) error {
+	if task.ready() {
+		return nil
+	}
+	fmt.Printf("Shuffling ReduceTask #%d of '%s'\n", task.N, task.Job)
+	tempdir = filepath.Join(tempdir, task.Job)
+	os.MkdirAll(tempdir, 0775)
+
+	db, err := createDatabase(filepath.Join(tempdir, reduceInputFile(task.N)))
+	if err != nil {
+		return fmt.Errorf("reduce task #%d: %v", task.N, err)
+	}
+	defer db.Close()
+
+	have := make([]string, task.M)
+	fetched := 0
+	hosts := task.SourceHosts
+	for {
+		for m, url := range hosts {
+			if url == "" || have[m] != "" {
+				continue
+			}
+			temp := filepath.Join(tempdir, reduceTempFile(task.N))
+			if err := download(url, temp); err != nil {
+				return &FetchError{Index: m, URL: url, Err: err}
+			}
+			if err := gatherInto(db, temp); err != nil {
+				return fmt.Errorf("reduce task #%d: %v", task.N, err)
+			}
+			have[m] = url
+			fetched++
+		}
+		if fetched == task.M {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if hosts, err = outputs(have); err != nil {
+			return err
+		}
+	}
+	task.SourceHosts = have
+	task.shuffled = true
 	return nil
 }
 
-func (task *ReduceTask) Process(tempdir string, client Interface) error {
-	fmt.Printf("Processing ReduceTask #%d\n", task.N)
+// Process runs the reduce task, stopping early with ctx.Err() if ctx is cancelled.
+// Any other failure, including an error from client.Reduce, is returned for the worker to report to the master.
+func (task *ReduceTask) Process(ctx context.Context, tempdir string, client Interface) error {
+	fmt.Printf("Processing ReduceTask #%d of '%s'\n", task.N, task.Job)
+	ctx = taskContext(ctx, TaskInfo{Job: task.Job, WorkType: 2, N: task.N, M: task.M, R: task.R})
+	tempdir = filepath.Join(tempdir, task.Job)
+	os.MkdirAll(tempdir, 0775)
 
 	// get a list of all the sourcefiles we need from sourcehosts
 
-	// Download and merge all map inputs into a Tempfile
-	mergeDatabases(task.SourceHosts, filepath.Join(tempdir, reduceInputFile(task.N)), filepath.Join(tempdir, reduceTempFile(task.N)))
+	// Download and merge all map inputs into a Tempfile, unless Shuffle already did
+	// a FetchError here tells the worker which map task needs to be run again
+	if !task.shuffled {
+		if _, err := mergeDatabases(task.SourceHosts, filepath.Join(tempdir, reduceInputFile(task.N)), filepath.Join(tempdir, reduceTempFile(task.N))); err != nil {
+			return err
+		}
+	}
+
+	// the order of the keys, and of each key's values, the collations have to be known before the input is opened.
+	// A Grouper's keys are ordered by their group key first, so the keys of a group follow each other.
+	// Keys the order ties are kept apart by their text
+	order := "order by "
+	less := keyLess(client, task.KeyOrder)
+	if g, ok := client.(Grouper); ok {
+		lessGroup := func(a, b string) bool { return g.Group(a) < g.Group(b) }
+		if less != nil {
+			// group keys the order ties are still different groups, they are kept apart by their text
+			lessGroup = func(a, b string) bool {
+				ga, gb := g.Group(a), g.Group(b)
+				return less(ga, gb) || !less(gb, ga) && ga < gb
+			}
+		}
+		collation, release := registerCollation(lessGroup)
+		defer release()
+		order += "key collate " + collation + ", "
+	}
+	if less != nil {
+		collation, release := registerCollation(less)
+		defer release()
+		order += "key collate " + collation + ", "
+	}
+	order += "key, value"
+	if v, ok := client.(ValueSorter); ok {
+		collation, release := registerCollation(v.LessValue)
+		defer release()
+		order += " collate " + collation
+	}
 
 	// create the input and output files
 	dbfile := filepath.Join(tempdir, reduceInputFile(task.N))
 	inputDb, err := openDatabase(dbfile)
 	if err != nil {
-		log.Fatalf("Error processing Reducetask: %v\n", err)
-		return nil
+		return fmt.Errorf("reduce task #%d: %v", task.N, err)
 	}
+	defer inputDb.Close()
 
 	dbfile = filepath.Join(tempdir, reduceOutputFile(task.N))
 	outputDb, err := createDatabase(dbfile)
 	if err != nil {
-		log.Fatalf("Error processing Reducetask: %v\n", err)
-		return nil
+		return fmt.Errorf("reduce task #%d: %v", task.N, err)
 	}
+	defer outputDb.Close()
 
 	// query the input file, getting keys and values in order
-	rows, err := inputDb.Query("select key, value from pairs order by key, value")
+	rows, err := inputDb.Query("select key, value from pairs " + order)
 	if err != nil {
-		log.Fatalf("Error processing Reducetask: %v\n", err)
-		return err
+		return fmt.Errorf("reduce task #%d: %v", task.N, err)
+	}
+	defer rows.Close()
+
+	reduce := client.Reduce
+	if c, ok := client.(ContextInterface); ok {
+		reduce = func(key string, values <-chan string, output chan<- Pair) error {
+			return c.ReduceContext(ctx, key, values, output)
+		}
+	}
+	var group func(string) string
+	if g, ok := client.(Grouper); ok {
+		group = g.Group
+	}
+	if err := reduceRows(ctx, rows, outputDb, group, "Reduce", reduce); err != nil {
+		return fmt.Errorf("reduce task #%d: %v", task.N, err)
 	}
 
+	return ctx.Err()
+}
+
+// reduceRows feeds rows, ordered by key, to reduce one key at a time, and writes its output to outputDb.
+// If group is set, reduce is called once per group key instead, with the values of every key in the group.
+// It stops early if ctx is cancelled, the first error is returned, naming the function that failed as name.
+func reduceRows(ctx context.Context, rows *sql.Rows, outputDb *sql.DB, group func(string) string, name string, reduce reduceFunc) error {
 	//setup variables for the main reduceloop
 	var previousKey string
-	valuesChan := make(chan string, 100)
-	complete := make(chan struct{})
-	firstrun := true
+	var valuesChan chan string
+	complete := make(chan error)
+	running := false
+	var reduceErr error
 
-	// this loop is in charge of feeding input to and managing the sub routines running client.Reduce
+	// this loop is in charge of feeding input to and managing the sub routines running reduce
 	for rows.Next() {
+		// stop early if the job was cancelled
+		if ctx.Err() != nil {
+			break
+		}
 		// put the pair into a Pair object
 		var key string
 		var value string
-		err = rows.Scan(&key, &value)
-		if err != nil {
-			log.Fatalf("Error processing Reducetask: %v\n", err)
+		if reduceErr = rows.Scan(&key, &value); reduceErr != nil {
+			break
 		}
-		// feed the pair into input
-		// check if its the first run of the loop
-		if firstrun {
-			firstrun = false
-			previousKey = key
-			go reduceRoutines(key, outputDb, client, valuesChan, complete)
+		if group != nil {
+			key = group(key)
 		}
 
-		// feed a value to the reduce routines every loop
-		valuesChan <- value
-
 		// compare new key to last key, if new key, close values channel
-		if key != previousKey {
-			previousKey = key
-			// close value channel, telling cleint.Reduce to finish
+		if running && key != previousKey {
+			// close value channel, telling reduce to finish
 			close(valuesChan)
-			// wait until reduce loop begins again
-			<-complete
-
+			running = false
+			// wait until reduce loop begins again, giving up on the task if it failed
+			if reduceErr = <-complete; reduceErr != nil {
+				break
+			}
+		}
+		if !running {
+			running = true
+			previousKey = key
 			valuesChan = make(chan string, 100)
-			go reduceRoutines(key, outputDb, client, valuesChan, complete)
+			go reduceRoutines(key, outputDb, name, reduce, valuesChan, complete)
 		}
+
+		// feed a value to the reduce routines every loop
+		valuesChan <- value
 	}
 	//out of keys, clean up loop
-	close(valuesChan)
-	<-complete
+	if running {
+		close(valuesChan)
+		if err := <-complete; reduceErr == nil {
+			reduceErr = err
+		}
+	}
+	if reduceErr != nil {
+		return reduceErr
+	}
+	return rows.Err()
+}
 
-	// close open databases
-	outputDb.Close()
-	inputDb.Close()
+// Process copies a reduce output, the worker then serves it from the same path as the reducer did
+func (task *ReplicaTask) Process(ctx context.Context, tempdir string) error {
+	fmt.Printf("Copying output of ReduceTask #%d of '%s'\n", task.N, task.Job)
+	tempdir = filepath.Join(tempdir, task.Job)
+	os.MkdirAll(tempdir, 0775)
 
-	return nil
+	if err := download(task.URL, filepath.Join(tempdir, reduceOutputFile(task.N))); err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
-// runs two goroutines, runs client.reduce and puts the output into a dabatase,
-// runs until valuesChan is closed, sends a struct through complete when finished
-func reduceRoutines(key string, outputDb *sql.DB, client Interface, valuesChan chan string, complete chan struct{}) {
+// runs two goroutines, runs reduce, named name in errors, and puts the output into a dabatase,
+// runs until valuesChan is closed, sends the first error, or nil, through complete when finished
+func reduceRoutines(key string, outputDb *sql.DB, name string, reduce reduceFunc, valuesChan chan string, complete chan error) {
 
 	// goroutine that loops over the output channel, taking values until its closed by client.Reduce
+	// it keeps draining the channel after a failed insert so client.Reduce is never left blocked
 	outputChan := make(chan Pair, 100)
-	finished := make(chan struct{})
+	finished := make(chan error)
 	go func() {
+		var insertErr error
 		for pair := range outputChan {
-			_, err := outputDb.Exec("insert into pairs (key, value) values (?,?)", pair.Key, pair.Value)
-			if err != nil {
-				log.Fatalf("Error processing Reducetask: %v\n", err)
+			if insertErr != nil {
+				continue
 			}
+			_, insertErr = outputDb.Exec("insert into pairs (key, value) values (?,?)", pair.Key, pair.Value)
 		}
-		finished <- struct{}{}
+		finished <- insertErr
 	}()
 
 	// Reduce(key string, values <-chan string, output chan<- Pair) error
 	// Reduce will run until the values channel is closed, it will then close the output channel
-	err := client.Reduce(key, valuesChan, outputChan)
+	err := reduce(key, valuesChan, outputChan)
+	// ensure that client.reduce has finished, and the outputchan goroutine is finished
+	insertErr := <-finished
+	// a Reduce that gave up early leaves values behind, drain them so the feeding loop is not blocked
+	for range valuesChan {
+	}
 	if err != nil {
-		log.Fatalf("Error processing Reducetask: %v\n", err)
+		complete <- fmt.Errorf("%s(%q): %v", name, key, err)
+		return
 	}
-	// ensure that client.reduce has finished, and the outputchan goroutine is finished
-	<-finished
-	close(finished)
-	complete <- struct{}{}
+	complete <- insertErr
 }
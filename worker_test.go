@@ -0,0 +1,181 @@
+package mapreduce
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// suffixGrouper groups keys like "a|x" by what follows the bar, which is not a prefix of the key
+type suffixGrouper struct{}
+
+func (suffixGrouper) Map(key, value string, output chan<- Pair) error {
+	defer close(output)
+	return nil
+}
+
+func (suffixGrouper) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	var all []string
+	for value := range values {
+		all = append(all, value)
+	}
+	output <- Pair{Key: key, Value: strings.Join(all, ",")}
+	return nil
+}
+
+func (suffixGrouper) Group(key string) string {
+	return key[strings.Index(key, "|")+1:]
+}
+
+// prefixGrouper groups keys like "a|1" by what comes before the bar
+type prefixGrouper struct{ suffixGrouper }
+
+func (prefixGrouper) Group(key string) string {
+	return key[:strings.Index(key, "|")]
+}
+
+// writePairs creates the database at path holding pairs, in order
+func writePairs(t *testing.T, path string, pairs []Pair) {
+	t.Helper()
+	db, err := createDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, pair := range pairs {
+		if _, err := db.Exec("insert into pairs (key, value) values (?, ?)", pair.Key, pair.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readPairs returns the pairs of the database at path, in rowid order
+func readPairs(t *testing.T, path string) []Pair {
+	t.Helper()
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select key, value from pairs order by rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var pairs []Pair
+	for rows.Next() {
+		var pair Pair
+		if err := rows.Scan(&pair.Key, &pair.Value); err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+func TestReduceGroupsKeysThatDoNotShareAPrefix(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	task := ReduceTask{Job: "job", M: 1, R: 1, N: 0, shuffled: true}
+	os.MkdirAll(filepath.Join(tempdir, task.Job), 0775)
+	writePairs(t, filepath.Join(tempdir, task.Job, reduceInputFile(0)), []Pair{
+		{Key: "d|y", Value: "4"}, {Key: "a|x", Value: "1"}, {Key: "c|x", Value: "3"}, {Key: "b|y", Value: "2"},
+	})
+
+	if err := task.Process(context.Background(), tempdir, suffixGrouper{}); err != nil {
+		t.Fatal(err)
+	}
+	got := readPairs(t, filepath.Join(tempdir, task.Job, reduceOutputFile(0)))
+	want := []Pair{{Key: "x", Value: "1,3"}, {Key: "y", Value: "2,4"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRangePartition(t *testing.T) {
+	// the points may come in any order
+	partition := rangePartition([]string{"p", "g"}, nil)
+	for key, want := range map[string]int{"a": 0, "f": 0, "g": 1, "m": 1, "p": 2, "z": 2} {
+		if got := partition(key, 3); got != want {
+			t.Errorf("text order: key %q goes to %v, want %v", key, got, want)
+		}
+	}
+
+	partition = rangePartition([]string{"10", "2"}, lessNumeric)
+	for key, want := range map[string]int{"1": 0, "2": 1, "9": 1, "10": 2, "100": 2, "x": 2} {
+		if got := partition(key, 3); got != want {
+			t.Errorf("numeric order: key %q goes to %v, want %v", key, got, want)
+		}
+	}
+
+	if got := rangePartition(nil, nil)("anything", 1); got != 0 {
+		t.Errorf("a single range: key goes to %v, want 0", got)
+	}
+}
+
+func TestReduceGroupsKeysTheKeyOrderTies(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "mapreduce_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	task := ReduceTask{Job: "job", M: 1, R: 1, N: 0, KeyOrder: "nocase", shuffled: true}
+	os.MkdirAll(filepath.Join(tempdir, task.Job), 0775)
+	writePairs(t, filepath.Join(tempdir, task.Job, reduceInputFile(0)), []Pair{
+		{Key: "A|1", Value: "1"}, {Key: "a|2", Value: "2"}, {Key: "A|3", Value: "3"},
+	})
+
+	if err := task.Process(context.Background(), tempdir, prefixGrouper{}); err != nil {
+		t.Fatal(err)
+	}
+	got := readPairs(t, filepath.Join(tempdir, task.Job, reduceOutputFile(0)))
+	want := []Pair{{Key: "A", Value: "1,3"}, {Key: "a", Value: "2"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+type panickingMapper struct{ suffixGrouper }
+
+func (panickingMapper) Map(key, value string, output chan<- Pair) error {
+	output <- Pair{Key: key, Value: value}
+	panic("bad record")
+}
+
+func TestCallMapClosesOutputAfterAPanic(t *testing.T) {
+	output := make(chan Pair, 1)
+	panicked, err := callMap(context.Background(), panickingMapper{}, "k", "v", output, true)
+	if !panicked || err == nil {
+		t.Fatalf("callMap = %v, %v, want the panic returned", panicked, err)
+	}
+	<-output
+	if _, open := <-output; open {
+		t.Errorf("output was left open")
+	}
+
+	// a Map that closed its output before panicking
+	output = make(chan Pair)
+	panicked, _ = callMap(context.Background(), closeThenPanic{}, "k", "v", output, true)
+	if !panicked {
+		t.Errorf("the panic was not recovered")
+	}
+}
+
+type closeThenPanic struct{ suffixGrouper }
+
+func (closeThenPanic) Map(key, value string, output chan<- Pair) error {
+	close(output)
+	panic("bad record")
+}